@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/plugin"
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v3"
+)
+
+// PluginConfig is the file format for our config, in JSON or YAML
+// (if the file name ends with .yaml or .yml)
+// ./plugin -config configuration.json
+//
+// Every field can be overridden by an environment variable named
+// HUMIO_JAEGER_ and the field name in upper snake case, for example
+// HUMIO_JAEGER_READ_TOKEN or HUMIO_JAEGER_INGEST_API.
+type PluginConfig struct {
+	ReadToken  string `json:"readToken" yaml:"readToken" secret:"true"`
+	WriteToken string `json:"writeToken" yaml:"writeToken" secret:"true"`
+
+	// ReadTokenFile and WriteTokenFile are read instead of the
+	// tokens above if set, and re-read when changed.
+	ReadTokenFile  string `json:"readTokenFile" yaml:"readTokenFile"`
+	WriteTokenFile string `json:"writeTokenFile" yaml:"writeTokenFile"`
+
+	Repo  string `json:"repo" yaml:"repo"`
+	Humio string `json:"humio" yaml:"humio"`
+
+	// ArchiveRepo enables archiving traces from the UI into a
+	// separate repository with its own tokens, usually with a longer
+	// retention than Repo
+	ArchiveRepo           string `json:"archiveRepo" yaml:"archiveRepo"`
+	ArchiveReadToken      string `json:"archiveReadToken" yaml:"archiveReadToken" secret:"true"`
+	ArchiveWriteToken     string `json:"archiveWriteToken" yaml:"archiveWriteToken" secret:"true"`
+	ArchiveReadTokenFile  string `json:"archiveReadTokenFile" yaml:"archiveReadTokenFile"`
+	ArchiveWriteTokenFile string `json:"archiveWriteTokenFile" yaml:"archiveWriteTokenFile"`
+
+	// Tenants maps each tenant to its own repository and tokens, and
+	// replaces Repo and the tokens above.  The tenant of each call is
+	// read from the TenantHeader gRPC metadata (default "x-tenant"),
+	// and calls for other tenants are rejected.  Tenants require
+	// ServeAddr.
+	Tenants      map[string]TenantConfig `json:"tenants" yaml:"tenants"`
+	TenantHeader string                  `json:"tenantHeader" yaml:"tenantHeader"`
+
+	// SchemaVersion of the span events written, 1 (default) or 2.
+	// Version 2 stores all tags with their types as "tag.<key>",
+	// see plugin.SchemaV2.  Both versions can be read.
+	SchemaVersion int `json:"schemaVersion" yaml:"schemaVersion"`
+
+	// PayloadEncoding of the span in the "payload" attribute, "json"
+	// (default), "proto" or "proto-gzip", see plugin.PayloadEncodings
+	PayloadEncoding string `json:"payloadEncoding" yaml:"payloadEncoding"`
+
+	// SpanLogEvents writes each span log as a separate event with
+	// the log fields as attributes, instead of only in the payload
+	SpanLogEvents bool `json:"spanLogEvents" yaml:"spanLogEvents"`
+
+	// PrecomputedDependencies serves dependencies written by the
+	// "dependencies" command instead of querying them periodically
+	PrecomputedDependencies bool `json:"precomputedDependencies" yaml:"precomputedDependencies"`
+
+	// IngestAPI ("humio-structured" or "hec") and QueryAPI ("query"
+	// or "queryjobs") override the endpoints detected from the
+	// server version
+	IngestAPI string `json:"ingestAPI" yaml:"ingestAPI"`
+	QueryAPI  string `json:"queryAPI" yaml:"queryAPI"`
+
+	// TLS and proxy settings, see humio.TransportConfig
+	CAFile             string `json:"caFile" yaml:"caFile"`
+	CertFile           string `json:"certFile" yaml:"certFile"`
+	KeyFile            string `json:"keyFile" yaml:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+	ProxyURL           string `json:"proxyURL" yaml:"proxyURL"`
+
+	// LogLevel (trace, debug, info, warn or error, default info) and
+	// LogFormat (json or text, default json).  LogLevels overrides
+	// the level per subsystem, for example "dependencies=debug".
+	LogLevel  string `json:"logLevel" yaml:"logLevel"`
+	LogFormat string `json:"logFormat" yaml:"logFormat"`
+	LogLevels string `json:"logLevels" yaml:"logLevels"`
+
+	// Connection pooling, zero means the default
+	MaxIdleConns        int `json:"maxIdleConns" yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost" yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int `json:"maxConnsPerHost" yaml:"maxConnsPerHost"`
+
+	// MetricsAddr, if set, is the address of a HTTP listener
+	// serving prometheus metrics on /metrics, for example ":9090"
+	MetricsAddr string `json:"metricsAddr" yaml:"metricsAddr"`
+
+	// HumioPlugin checks humio every HealthCheckInterval (default
+	// 30s), for the gRPC health check made by jaeger.  HealthAddr, if
+	// set, is the address of a HTTP listener also serving the results
+	// as /healthz (liveness) and /readyz (readiness).  It may be the
+	// same as MetricsAddr.
+	HealthAddr          string `json:"healthAddr" yaml:"healthAddr"`
+	HealthCheckInterval string `json:"healthCheckInterval" yaml:"healthCheckInterval"`
+
+	// SelfTracing exports traces of the plugin itself with OTLP,
+	// configured by the OTEL_* environment variables.
+	// SelfTracingSampleRatio is the fraction of operations traced; 0
+	// (default) leaves sampling to OTEL_TRACES_SAMPLER and
+	// OTEL_TRACES_SAMPLER_ARG.  The ingest path is not traced unless
+	// SelfTracingIngest is set, as every span written would then
+	// produce new spans to write.
+	SelfTracing            bool    `json:"selfTracing" yaml:"selfTracing"`
+	SelfTracingSampleRatio float64 `json:"selfTracingSampleRatio" yaml:"selfTracingSampleRatio"`
+	SelfTracingIngest      bool    `json:"selfTracingIngest" yaml:"selfTracingIngest"`
+
+	// ServeAddr, if set (or -serve-addr), serves jaeger's remote
+	// storage gRPC API on this address instead of running as a
+	// plugin subprocess.  ServeCertFile and ServeKeyFile enable TLS,
+	// and ServeBearerToken or ServeBearerTokenFile require clients to
+	// send "authorization: Bearer <token>" or "bearer.token: <token>",
+	// see bearerAuth.
+	ServeAddr            string `json:"serveAddr" yaml:"serveAddr"`
+	ServeCertFile        string `json:"serveCertFile" yaml:"serveCertFile"`
+	ServeKeyFile         string `json:"serveKeyFile" yaml:"serveKeyFile"`
+	ServeBearerToken     string `json:"serveBearerToken" yaml:"serveBearerToken" secret:"true"`
+	ServeBearerTokenFile string `json:"serveBearerTokenFile" yaml:"serveBearerTokenFile"`
+}
+
+// TenantConfig is the repository and tokens of a tenant, see
+// PluginConfig.Tenants
+type TenantConfig struct {
+	Repo           string `json:"repo" yaml:"repo"`
+	ReadToken      string `json:"readToken" yaml:"readToken" secret:"true"`
+	WriteToken     string `json:"writeToken" yaml:"writeToken" secret:"true"`
+	ReadTokenFile  string `json:"readTokenFile" yaml:"readTokenFile"`
+	WriteTokenFile string `json:"writeTokenFile" yaml:"writeTokenFile"`
+}
+
+// envPrefix is prepended to the environment variables overriding the
+// config, see PluginConfig
+const envPrefix = "HUMIO_JAEGER_"
+
+// readConfig reads and validates the configuration, see loadConfig
+func readConfig(path string) (*PluginConfig, error) {
+	pluginConfig, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return pluginConfig, pluginConfig.validate()
+}
+
+// loadConfig reads the config file (if path is not empty) and applies
+// environment overrides
+func loadConfig(path string) (*PluginConfig, error) {
+	var pluginConfig PluginConfig
+	if path != "" {
+		if err := decodeConfig(path, &pluginConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pluginConfig.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return &pluginConfig, nil
+}
+
+// printConfig implements -print-config, and writes the effective
+// configuration to stdout with secrets redacted
+func printConfig(path string) int {
+	pluginConfig, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(pluginConfig.redacted())
+
+	if err := pluginConfig.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// decodeConfig decodes JSON or YAML, and rejects unknown fields to
+// catch typos
+func decodeConfig(path string, pluginConfig *PluginConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(pluginConfig); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(pluginConfig); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// envName returns the environment variable for a field, such as
+// HUMIO_JAEGER_INGEST_API for ingestAPI
+func envName(field string) string {
+	var sb strings.Builder
+	sb.WriteString(envPrefix)
+	runes := []rune(field)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// applyEnv overrides fields with values from the environment
+func (c *PluginConfig) applyEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := envName(field.Tag.Get("json"))
+		value, found := lookup(name)
+		if !found {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.Field(i).SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.Field(i).SetInt(int64(n))
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.Field(i).SetFloat(f)
+		case reflect.Map:
+			if err := json.Unmarshal([]byte(value), v.Field(i).Addr().Interface()); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		default:
+			panic("unsupported config field type " + field.Type.String())
+		}
+	}
+	return nil
+}
+
+// validate returns an error listing every problem with the config
+func (c *PluginConfig) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Humio == "" {
+		problem(`"humio" must be set to the URL of humio, for example "https://cloud.humio.com"`)
+	} else if u, err := url.Parse(c.Humio); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problem(`"humio" must be an absolute http or https URL, got %q`, c.Humio)
+	}
+
+	if len(c.Tenants) > 0 {
+		if c.Repo != "" || c.ReadToken != "" || c.ReadTokenFile != "" || c.WriteToken != "" || c.WriteTokenFile != "" {
+			problem(`"repo" and its tokens must not be set together with "tenants", set them per tenant`)
+		}
+
+		if c.ArchiveRepo != "" {
+			problem(`"archiveRepo" is not supported together with "tenants"`)
+		}
+
+		// jaeger does not forward the tenant to a plugin subprocess,
+		// so every call would be rejected
+		if c.ServeAddr == "" {
+			problem(`"tenants" requires "serveAddr" (or -serve-addr), as jaeger does not send the tenant to storage plugins`)
+		}
+
+		for name, tenant := range c.Tenants {
+			if name == "" {
+				problem(`"tenants" must not contain an empty tenant name`)
+			}
+			if tenant.Repo == "" {
+				problem(`"repo" must be set for tenant %q`, name)
+			}
+			if tenant.ReadToken == "" && tenant.ReadTokenFile == "" {
+				problem(`"readToken" or "readTokenFile" must be set for tenant %q`, name)
+			}
+			if tenant.WriteToken == "" && tenant.WriteTokenFile == "" {
+				problem(`"writeToken" or "writeTokenFile" must be set for tenant %q`, name)
+			}
+		}
+	} else {
+		if c.Repo == "" {
+			problem(`"repo" must be set to the humio repository`)
+		}
+
+		if c.ReadToken == "" && c.ReadTokenFile == "" {
+			problem(`"readToken", "readTokenFile" or %s must be set to an API token which can search the repository`, envName("readToken"))
+		}
+
+		if c.WriteToken == "" && c.WriteTokenFile == "" {
+			problem(`"writeToken", "writeTokenFile" or %s must be set to an ingest token for the repository`, envName("writeToken"))
+		}
+
+		if c.TenantHeader != "" {
+			problem(`"tenantHeader" requires "tenants"`)
+		}
+	}
+
+	archiveTokens := c.ArchiveReadToken != "" || c.ArchiveReadTokenFile != "" || c.ArchiveWriteToken != "" || c.ArchiveWriteTokenFile != ""
+	if c.ArchiveRepo == "" && archiveTokens {
+		problem(`"archiveRepo" must be set when archive tokens are given`)
+	} else if c.ArchiveRepo != "" {
+		if c.ArchiveReadToken == "" && c.ArchiveReadTokenFile == "" {
+			problem(`"archiveReadToken", "archiveReadTokenFile" or %s must be set to an API token which can search the archive repository`, envName("archiveReadToken"))
+		}
+		if c.ArchiveWriteToken == "" && c.ArchiveWriteTokenFile == "" {
+			problem(`"archiveWriteToken", "archiveWriteTokenFile" or %s must be set to an ingest token for the archive repository`, envName("archiveWriteToken"))
+		}
+	}
+
+	switch humio.IngestAPI(c.IngestAPI) {
+	case "", humio.IngestStructured, humio.IngestHEC:
+	default:
+		problem(`"ingestAPI" must be %q or %q, got %q`, humio.IngestStructured, humio.IngestHEC, c.IngestAPI)
+	}
+
+	switch humio.QueryAPI(c.QueryAPI) {
+	case "", humio.QuerySync, humio.QueryJobs:
+	default:
+		problem(`"queryAPI" must be %q or %q, got %q`, humio.QuerySync, humio.QueryJobs, c.QueryAPI)
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		problem(`"certFile" and "keyFile" must be set together`)
+	}
+
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Host == "" {
+			problem(`"proxyURL" must be an absolute URL, got %q`, c.ProxyURL)
+		}
+	}
+
+	if c.LogLevel != "" && hclog.LevelFromString(c.LogLevel) == hclog.NoLevel {
+		problem(`"logLevel" must be trace, debug, info, warn or error, got %q`, c.LogLevel)
+	}
+
+	if c.LogFormat != "" && c.LogFormat != "json" && c.LogFormat != "text" {
+		problem(`"logFormat" must be json or text, got %q`, c.LogFormat)
+	}
+
+	if _, err := parseLogLevels(c.LogLevels); err != nil {
+		problem(`"logLevels": %v`, err)
+	}
+
+	if c.SchemaVersion < 0 || c.SchemaVersion > plugin.SchemaV2 {
+		problem(`"schemaVersion" must be %d or %d, got %d`, plugin.SchemaV1, plugin.SchemaV2, c.SchemaVersion)
+	}
+
+	switch c.PayloadEncoding {
+	case "", plugin.PayloadJSON, plugin.PayloadProto, plugin.PayloadProtoGzip:
+	default:
+		problem(`"payloadEncoding" must be one of %s, got %q`, strings.Join(plugin.PayloadEncodings, ", "), c.PayloadEncoding)
+	}
+
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		problem(`connection pool limits must not be negative`)
+	}
+
+	if c.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddr); err != nil {
+			problem(`"healthAddr" must be a host:port address, got %q`, c.HealthAddr)
+		}
+	}
+
+	if c.HealthCheckInterval != "" {
+		if d, err := time.ParseDuration(c.HealthCheckInterval); err != nil || d <= 0 {
+			problem(`"healthCheckInterval" must be a positive duration such as "30s", got %q`, c.HealthCheckInterval)
+		}
+	}
+
+	if c.SelfTracingSampleRatio < 0 || c.SelfTracingSampleRatio > 1 {
+		problem(`"selfTracingSampleRatio" must be between 0 and 1, got %v`, c.SelfTracingSampleRatio)
+	}
+
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			problem(`"metricsAddr" must be a host:port address, got %q`, c.MetricsAddr)
+		}
+	}
+
+	if c.ServeAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ServeAddr); err != nil {
+			problem(`"serveAddr" must be a host:port address, got %q`, c.ServeAddr)
+		}
+	} else if c.ServeCertFile != "" || c.ServeKeyFile != "" || c.ServeBearerToken != "" || c.ServeBearerTokenFile != "" {
+		problem(`"serveAddr" must be set when TLS or a bearer token is configured for the gRPC server`)
+	}
+
+	if (c.ServeCertFile == "") != (c.ServeKeyFile == "") {
+		problem(`"serveCertFile" and "serveKeyFile" must be set together`)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// redacted returns a copy of the config with secrets replaced, for
+// printing
+func (c *PluginConfig) redacted() *PluginConfig {
+	ret := *c
+	v := reflect.ValueOf(&ret).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("REDACTED")
+		}
+	}
+
+	if c.Tenants != nil {
+		ret.Tenants = make(map[string]TenantConfig, len(c.Tenants))
+		for name, tenant := range c.Tenants {
+			if tenant.ReadToken != "" {
+				tenant.ReadToken = "REDACTED"
+			}
+			if tenant.WriteToken != "" {
+				tenant.WriteToken = "REDACTED"
+			}
+			ret.Tenants[name] = tenant
+		}
+	}
+	return &ret
+}
+
+// tokenSource returns a token source for the file if set, otherwise
+// the token from the config
+func tokenSource(token, file string) (humio.TokenSource, error) {
+	if file != "" {
+		return humio.NewFileToken(file)
+	}
+
+	return humio.StaticToken(token), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestEnvName(t *testing.T) {
+	for field, want := range map[string]string{
+		"readToken":           "HUMIO_JAEGER_READ_TOKEN",
+		"ingestAPI":           "HUMIO_JAEGER_INGEST_API",
+		"caFile":              "HUMIO_JAEGER_CA_FILE",
+		"proxyURL":            "HUMIO_JAEGER_PROXY_URL",
+		"maxIdleConnsPerHost": "HUMIO_JAEGER_MAX_IDLE_CONNS_PER_HOST",
+		"humio":               "HUMIO_JAEGER_HUMIO",
+	} {
+		if got := envName(field); got != want {
+			t.Errorf("envName(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestDecodeConfigUnknownField(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.json": `{"humoi": "https://cloud.humio.com"}`,
+		"config.yaml": "humoi: https://cloud.humio.com\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var c PluginConfig
+		if err := decodeConfig(path, &c); err == nil || !strings.Contains(err.Error(), "humoi") {
+			t.Errorf("%s: expected error about unknown field, got %v", name, err)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := PluginConfig{Repo: "from-file"}
+	env := map[string]string{
+		"HUMIO_JAEGER_REPO":                      "from-env",
+		"HUMIO_JAEGER_INSECURE_SKIP_VERIFY":      "true",
+		"HUMIO_JAEGER_MAX_IDLE_CONNS_PER_HOST":   "4",
+		"HUMIO_JAEGER_PRECOMPUTED_DEPENDENCIES":  "1",
+		"HUMIO_JAEGER_SELF_TRACING_SAMPLE_RATIO": "0.25",
+		"HUMIO_JAEGER_TENANTS":                   `{"team-a": {"repo": "a"}}`,
+	}
+
+	if err := c.applyEnv(func(k string) (string, bool) { v, ok := env[k]; return v, ok }); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Repo != "from-env" || !c.InsecureSkipVerify || c.MaxIdleConnsPerHost != 4 || !c.PrecomputedDependencies || c.SelfTracingSampleRatio != 0.25 || c.Tenants["team-a"].Repo != "a" {
+		t.Errorf("environment not applied: %+v", c)
+	}
+
+	env = map[string]string{"HUMIO_JAEGER_MAX_CONNS_PER_HOST": "many"}
+	if err := c.applyEnv(func(k string) (string, bool) { v, ok := env[k]; return v, ok }); err == nil {
+		t.Error("expected error for invalid integer")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := PluginConfig{
+		Humio:          "https://cloud.humio.com",
+		Repo:           "sandbox",
+		ReadToken:      "read",
+		WriteTokenFile: "/var/run/secrets/humio/ingest-token",
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	invalid := valid
+	invalid.Humio = "cloud.humio.com"
+	invalid.IngestAPI = "syslog"
+	invalid.CertFile = "cert.pem"
+	invalid.MetricsAddr = "9090"
+	invalid.HealthCheckInterval = "30"
+	invalid.ArchiveRepo = "archive"
+	invalid.ArchiveReadToken = "read"
+	invalid.ServeCertFile = "server.pem"
+	invalid.SchemaVersion = 3
+	invalid.PayloadEncoding = "xml"
+	err := invalid.validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, field := range []string{`"humio"`, `"ingestAPI"`, `"certFile"`, `"metricsAddr"`, `"healthCheckInterval"`, `"archiveWriteToken"`, `"serveAddr"`, `"serveKeyFile"`, `"schemaVersion"`, `"payloadEncoding"`} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected problem with %s in %v", field, err)
+		}
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	valid := PluginConfig{
+		Humio:     "https://cloud.humio.com",
+		ServeAddr: ":17271",
+		Tenants: map[string]TenantConfig{
+			"team-a": {Repo: "a", ReadToken: "read", WriteTokenFile: "/var/run/secrets/team-a/ingest-token"},
+		},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	subprocess := valid
+	subprocess.ServeAddr = ""
+	if err := subprocess.validate(); err == nil || !strings.Contains(err.Error(), `"tenants" requires "serveAddr"`) {
+		t.Errorf("expected tenants to require serveAddr, got %v", err)
+	}
+
+	invalid := valid
+	invalid.Repo = "sandbox"
+	invalid.Tenants = map[string]TenantConfig{"team-b": {Repo: "b"}}
+	err := invalid.validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, problem := range []string{`"repo" and its tokens`, `"readToken" or "readTokenFile" must be set for tenant "team-b"`, `"writeToken" or "writeTokenFile" must be set for tenant "team-b"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected problem %s in %v", problem, err)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := PluginConfig{ReadToken: "secret", Repo: "sandbox", Tenants: map[string]TenantConfig{"team-a": {WriteToken: "secret"}}}
+	r := c.redacted()
+	if r.ReadToken != "REDACTED" || r.WriteToken != "" || r.Repo != "sandbox" || r.Tenants["team-a"].WriteToken != "REDACTED" {
+		t.Errorf("unexpected redacted config %+v", r)
+	}
+
+	if c.ReadToken != "secret" || c.Tenants["team-a"].WriteToken != "secret" {
+		t.Error("original config was modified")
+	}
+}
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels("dependencies=debug, client=trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if levels["dependencies"] != hclog.Debug || levels["client"] != hclog.Trace || len(levels) != 2 {
+		t.Errorf("unexpected levels %v", levels)
+	}
+
+	for _, bad := range []string{"debug", "frontend=debug", "client=loud"} {
+		if _, err := parseLogLevels(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
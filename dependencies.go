@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+// runDependencies implements the "dependencies" command, which
+// computes service dependencies for a time range and writes them back
+// to humio.  It is meant to run periodically, for example as a
+// kubernetes CronJob, together with "precomputedDependencies": true
+// in the plugin config.
+//
+//	humio-jaeger-storage dependencies -config conf.json -from 2022-10-01T10:00:00Z -to 2022-10-01T11:00:00Z
+func runDependencies(args []string) int {
+	var configPath, from, to, tenant string
+	flags := flag.NewFlagSet("dependencies", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	flags.StringVar(&from, "from", "", "Start of time range, RFC3339 (default: one hour before -to)")
+	flags.StringVar(&to, "to", "", "End of time range, RFC3339 (default: now)")
+	flags.StringVar(&tenant, "tenant", "", "The tenant to compute dependencies for, if the config has tenants")
+	flags.Parse(args)
+
+	logger := newLogger(nil)
+
+	end := time.Now()
+	if to != "" {
+		var err error
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			logger.Error("Invalid -to", "err", err)
+			return 2
+		}
+	}
+
+	start := end.Add(-time.Hour)
+	if from != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			logger.Error("Invalid -from", "err", err)
+			return 2
+		}
+	}
+
+	if !start.Before(end) {
+		logger.Error("-from must be before -to", "from", start, "to", end)
+		return 2
+	}
+
+	config, err := readConfig(configPath)
+	if err != nil {
+		logger.Error("Reading config failed", "err", err.Error())
+		return 1
+	}
+	logger = newLogger(config)
+
+	plugin, err := newPlugin(config, logger)
+	if err != nil {
+		logger.Error("Configuring plugin failed", "err", err)
+		return 1
+	}
+
+	if len(config.Tenants) > 0 {
+		router, err := newTenantRouter(config, plugin)
+		if err != nil {
+			logger.Error("Configuring tenants failed", "err", err)
+			return 1
+		}
+
+		if plugin = router.Tenants[tenant]; plugin == nil {
+			logger.Error("-tenant must be one of the configured tenants", "tenant", tenant)
+			return 2
+		}
+	} else if tenant != "" {
+		logger.Error("-tenant requires tenants in the config")
+		return 2
+	}
+
+	ctx := context.Background()
+
+	links, err := plugin.ComputeDependencies(ctx, start, end)
+	if err != nil {
+		logger.Error("Computing dependencies failed", "err", err)
+		return 1
+	}
+
+	if err := plugin.WriteDependencies(ctx, end, links); err != nil {
+		logger.Error("Writing dependencies failed", "err", err)
+		return 1
+	}
+
+	logger.Info("Wrote dependencies", "links", len(links), "from", start, "to", end)
+	return 0
+}
@@ -0,0 +1,195 @@
+// Package health runs periodic checks of the plugin's dependencies,
+// and exposes the results as liveness and readiness probes over HTTP
+// and through the gRPC health service used by jaeger to ping plugins.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// DefaultInterval is used if Checker.Interval is not set
+const DefaultInterval = 30 * time.Second
+
+var checkUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "humio_jaeger",
+	Name:      "health_check_up",
+	Help:      "1 if the last run of the health check succeeded, 0 otherwise.",
+}, []string{"check"})
+
+// A Check returns an error if a dependency is not usable
+type Check func(ctx context.Context) error
+
+// Result is the outcome of the last run of a check
+type Result struct {
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Checker runs the checks every Interval.  Create it with the checks
+// set, and start Run in a goroutine.
+type Checker struct {
+	Checks   map[string]Check
+	Interval time.Duration
+	Logger   hclog.Logger
+
+	mu      sync.Mutex
+	started time.Time
+	lastRun time.Time
+	results map[string]Result
+}
+
+func (c *Checker) interval() time.Duration {
+	if c.Interval <= 0 {
+		return DefaultInterval
+	}
+	return c.Interval
+}
+
+func (c *Checker) logger() hclog.Logger {
+	if c.Logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return c.Logger
+}
+
+// Run runs the checks until ctx is cancelled
+func (c *Checker) Run(ctx context.Context) {
+	c.mu.Lock()
+	c.started = time.Now()
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(c.interval())
+	defer ticker.Stop()
+	for {
+		c.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce runs all checks concurrently, each bounded by the interval,
+// and stores the results
+func (c *Checker) RunOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.interval())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[string]Result, len(c.Checks))
+	for name, check := range c.Checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := check(ctx)
+
+			result := Result{Time: time.Now()}
+			if err != nil {
+				result.Error = err.Error()
+				checkUp.WithLabelValues(name).Set(0)
+			} else {
+				checkUp.WithLabelValues(name).Set(1)
+			}
+
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, result := range results {
+		if result.Error != "" && c.results[name].Error == "" {
+			c.logger().Warn("Health check failed", "check", name, "err", result.Error)
+		} else if result.Error == "" && c.results[name].Error != "" {
+			c.logger().Info("Health check recovered", "check", name)
+		}
+	}
+	c.results = results
+	c.lastRun = time.Now()
+}
+
+// Ready returns true if all checks passed on the last run, and the
+// results of that run
+func (c *Checker) Ready() (bool, map[string]Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ready := c.results != nil
+	results := make(map[string]Result, len(c.results))
+	for name, result := range c.results {
+		results[name] = result
+		if result.Error != "" {
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+// Live returns false if the checks have not completed for a few
+// intervals, which means the process is stuck.  Failing checks do not
+// affect liveness, as restarting will not fix humio.
+func (c *Checker) Live() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := c.lastRun
+	if last.IsZero() {
+		last = c.started
+	}
+	return last.IsZero() || time.Since(last) < 3*c.interval()
+}
+
+// LiveHandler responds 200 if Live, and 503 otherwise
+func (c *Checker) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.Live() {
+			http.Error(w, "health checks are stuck", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadyHandler responds 200 if Ready, and 503 otherwise, with the
+// check results as JSON
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, results := c.Ready()
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]Result `json:"checks"`
+		}{ready, results})
+	})
+}
+
+// UnaryServerInterceptor answers the gRPC health checks made by
+// jaeger (through go-plugin) with NOT_SERVING when the checker is not
+// Live.  jaeger exits when a plugin is unhealthy, so readiness is
+// only reported over HTTP.
+func (c *Checker) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/grpc.health.v1.Health/Check" && !c.Live() {
+			return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+		}
+		return handler(ctx, req)
+	}
+}
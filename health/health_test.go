@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestChecker(t *testing.T) {
+	c := &Checker{Checks: map[string]Check{
+		"ok":     func(ctx context.Context) error { return nil },
+		"broken": func(ctx context.Context) error { return errors.New("401 Unauthorized") },
+	}}
+
+	if ready, _ := c.Ready(); ready {
+		t.Error("expected not ready before the first run")
+	}
+
+	c.RunOnce(context.Background())
+	ready, results := c.Ready()
+	if ready || results["ok"].Error != "" || results["broken"].Error != "401 Unauthorized" {
+		t.Errorf("unexpected results %v %+v", ready, results)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from /readyz, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	c.LiveHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from /healthz, got %d", rec.Code)
+	}
+
+	delete(c.Checks, "broken")
+	c.RunOnce(context.Background())
+	if ready, _ := c.Ready(); !ready {
+		t.Error("expected ready")
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	c := &Checker{lastRun: time.Now().Add(-time.Hour)}
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	serving := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+	}
+
+	resp, err := c.UnaryServerInterceptor()(context.Background(), nil, info, serving)
+	if err != nil || resp.(*grpc_health_v1.HealthCheckResponse).Status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING when checks are stuck, got %v %v", resp, err)
+	}
+
+	c.lastRun = time.Now()
+	resp, err = c.UnaryServerInterceptor()(context.Background(), nil, info, serving)
+	if err != nil || resp.(*grpc_health_v1.HealthCheckResponse).Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("expected SERVING, got %v %v", resp, err)
+	}
+}
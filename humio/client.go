@@ -3,21 +3,55 @@ package humio
 import (
 	"context"
 	"net/http"
+	"strconv"
 
-	"github.com/opentracing-contrib/go-stdlib/nethttp"
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+// tracer creates the spans of the humio client.  It uses the global
+// tracer provider, which is a no-op unless self-tracing is enabled.
+var tracer = otel.Tracer("github.com/chlunde/humio-jaeger-storage/humio")
+
 const DefaultBaseURL = "https://cloud.humio.com"
 
 // A Client is a HTTP REST client for the humio APIs.  You must at
-// least initialize the Token field.  Unless BaseURL is set,
-// cloud.humio.com will be used.
+// least initialize the Token or TokenSource field.  Unless BaseURL is
+// set, cloud.humio.com will be used.
 type Client struct {
 	Client  *http.Client
 	BaseURL string
 	Token   string
+
+	// TokenSource, if set, is used instead of Token
+	TokenSource TokenSource
+
+	// Retry is used by DoIdempotent and DoUnlessSent. If nil, requests
+	// are not retried.
+	Retry RetryPolicy
+
+	// Limiter, if set, limits the rate of requests from this
+	// client. Copies of the client share the limiter.
+	Limiter *rate.Limiter
+
+	// Logger, if set, receives debug messages about retries and
+	// failed cleanups
+	Logger hclog.Logger
+
+	// IngestAPI and QueryAPI select the endpoints to use, see
+	// Detect.  By default, the legacy humio endpoints are used.
+	IngestAPI IngestAPI
+	QueryAPI  QueryAPI
+
+	// DisableTracing suppresses spans for requests from this
+	// client, for example to avoid tracing the ingest of spans
+	DisableTracing bool
 }
 
 func (c *Client) GetBaseURL() string {
@@ -27,30 +61,72 @@ func (c *Client) GetBaseURL() string {
 	return c.BaseURL
 }
 
+func (c *Client) logger() hclog.Logger {
+	if c.Logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return c.Logger
+}
+
 // Do performs the given HTTP request but sets the Authorization header
 func (c *Client) Do(ctx context.Context, req *http.Request) (*http.Response, func(), error) {
-	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, func() {}, err
+		}
+	}
+
+	token := c.Token
+	if c.TokenSource != nil {
+		var err error
+		if token, err = c.TokenSource.Token(); err != nil {
+			return nil, func() {}, err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	client := http.DefaultClient
 	if c.Client != nil {
 		client = c.Client
 	}
 
-	req = req.WithContext(ctx)
-	req, ht := nethttp.TraceRequest(opentracing.GlobalTracer(), req, nethttp.ComponentName("humio-client"), nethttp.ClientSpanObserver(func(span opentracing.Span, r *http.Request) {
-		ext.PeerService.Set(span, "humio")
-	}))
+	ctx, span := c.tracer().Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+			semconv.PeerServiceKey.String("humio"),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
+	req = req.WithContext(ctx)
 	resp, err := client.Do(req)
+	code := "0"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	}
+	metrics.HTTPRequests.WithLabelValues(metrics.Endpoint(req.URL.Path), code).Inc()
+
 	// If we got an error, and the context has been canceled,
 	// the context's error is probably more useful.
 	if err != nil {
-		ext.Error.Set(ht.Span(), true)
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
 		default:
 		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return resp, func() { span.End() }, err
+}
+
+// tracer returns a no-op tracer if tracing is disabled for this client
+func (c *Client) tracer() trace.Tracer {
+	if c.DisableTracing {
+		return trace.NewNoopTracerProvider().Tracer("")
 	}
-	return resp, ht.Finish, err
+	return tracer
 }
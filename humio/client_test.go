@@ -0,0 +1,47 @@
+package humio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDisableTracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	client := testServerClient(srv.URL, nil)
+	client.DisableTracing = true
+
+	i := &BatchIngester{Client: client}
+	i.AddEvent(map[string]string{}, Event{Attributes: map[string]interface{}{"k": "v"}})
+	if err := i.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("expected no spans, got %v", spans)
+	}
+
+	client.DisableTracing = false
+	i.AddEvent(map[string]string{}, Event{Attributes: map[string]interface{}{"k": "v"}})
+	if err := i.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if spans := recorder.Ended(); len(spans) == 0 {
+		t.Error("expected spans with tracing enabled")
+	}
+}
@@ -0,0 +1,92 @@
+package humio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// An APIError is returned when humio responds with an unexpected HTTP
+// status. Use the IsRetryable, IsAuth and IsQuerySyntax helpers to
+// classify it.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Method     string
+	Endpoint   string // URL path of the request
+	RequestID  string // from the X-Request-Id response header, if any
+	Body       string // excerpt of the response body
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("unexpected HTTP status %s from %s %s", e.Status, e.Method, e.Endpoint)
+	if e.RequestID != "" {
+		msg += " (request id " + e.RequestID + ")"
+	}
+	return msg + ": " + e.Body
+}
+
+// newAPIError creates an APIError from the response, including up to
+// body, which should be an excerpt of the response body.
+func newAPIError(resp *http.Response, body string) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RequestID:  resp.Header.Get("X-Request-Id"),
+		Body:       body,
+	}
+
+	if resp.Request != nil && resp.Request.URL != nil {
+		e.Method = resp.Request.Method
+		e.Endpoint = resp.Request.URL.Path
+	}
+
+	return e
+}
+
+// retryableStatus returns true for HTTP statuses which signal that
+// humio is overloaded or temporarily unavailable.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsRetryable returns true if err is a transport error or an
+// APIError for a request which may succeed if repeated later.  Other
+// errors, such as unparsable results or a failing TokenSource, are not
+// retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.StatusCode)
+	}
+
+	// *url.Error, returned by http.Client, and the errors of reading a
+	// response body from a broken connection
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsAuth returns true if humio rejected the token
+func IsAuth(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// IsQuerySyntax returns true if humio rejected a query, typically
+// because of a syntax error in the query string
+func IsQuerySyntax(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && strings.Contains(apiErr.Endpoint, "/query")
+}
@@ -0,0 +1,70 @@
+package humio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestExpectStatusAPIError(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Status:     "400 Bad Request",
+		Header:     http.Header{"X-Request-Id": []string{"abc123"}},
+		Body:       io.NopCloser(strings.NewReader("Unknown function: grupBy")),
+		Request: &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/api/v1/repositories/sandbox/query"},
+		},
+	}
+
+	err := expectStatus(context.Background(), resp, http.StatusOK)
+	wrapped := fmt.Errorf("findTraceIDs: %w", err)
+
+	if !IsQuerySyntax(wrapped) {
+		t.Errorf("expected IsQuerySyntax for %v", err)
+	}
+
+	if IsAuth(wrapped) || IsRetryable(wrapped) {
+		t.Errorf("unexpected classification of %v", err)
+	}
+
+	want := "unexpected HTTP status 400 Bad Request from POST /api/v1/repositories/sandbox/query (request id abc123): Unknown function: grupBy"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+		auth      bool
+	}{
+		{&APIError{StatusCode: http.StatusUnauthorized}, false, true},
+		{&APIError{StatusCode: http.StatusForbidden}, false, true},
+		{&APIError{StatusCode: http.StatusTooManyRequests}, true, false},
+		{&APIError{StatusCode: http.StatusServiceUnavailable}, true, false},
+		{&APIError{StatusCode: http.StatusInternalServerError}, false, false},
+		{io.ErrUnexpectedEOF, true, false},
+		{&url.Error{Op: "Post", URL: "https://humio", Err: errors.New("connection refused")}, true, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, true, false},
+		{context.Canceled, false, false},
+		{&url.Error{Op: "Post", URL: "https://humio", Err: context.Canceled}, false, false},
+		{errors.New("invalid character 'x' looking for beginning of value"), false, false},
+		{fmt.Errorf("reading token: %w", errors.New("no such file")), false, false},
+	} {
+		if got := IsRetryable(tc.err); got != tc.retryable {
+			t.Errorf("IsRetryable(%v) = %v", tc.err, got)
+		}
+		if got := IsAuth(tc.err); got != tc.auth {
+			t.Errorf("IsAuth(%v) = %v", tc.err, got)
+		}
+	}
+}
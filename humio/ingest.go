@@ -5,18 +5,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// Event is an event to ingest.  The attributes may be any value
+// encodable as JSON, such as numbers and booleans, which humio parses
+// as native fields.
 type Event struct {
-	Timestamp  IngestTime        `json:"timestamp"`
-	Attributes map[string]string `json:"attributes"`
+	Timestamp  IngestTime             `json:"timestamp"`
+	Attributes map[string]interface{} `json:"attributes"`
 }
 
 type IngestTime struct {
@@ -63,6 +70,7 @@ func (b *BatchIngester) AddEvent(tags map[string]string, e Event) {
 	}
 
 	es.Events = append(es.Events, e)
+	metrics.BufferedEvents.Inc()
 }
 
 /*
@@ -91,6 +99,32 @@ func (b *BatchIngester) AddEvent(tags map[string]string, e Event) {
 ]
 */
 
+// hecEvent is the Splunk HTTP Event Collector format, see
+// https://library.humio.com/reference/api/ingest/#hec
+type hecEvent struct {
+	Time   float64                `json:"time"` // seconds since epoch
+	Event  map[string]interface{} `json:"event"`
+	Fields map[string]string      `json:"fields,omitempty"`
+}
+
+// encodeHEC writes the events as a stream of HEC JSON objects. The
+// stream tags are sent as fields, as HEC has no concept of tags.
+func encodeHEC(w io.Writer, streams []eventStream) error {
+	enc := json.NewEncoder(w)
+	for _, es := range streams {
+		for _, e := range es.Events {
+			if err := enc.Encode(hecEvent{
+				Time:   float64(e.Timestamp.UnixNano()) / 1e9,
+				Event:  e.Attributes,
+				Fields: es.Tags,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (i *BatchIngester) Flush(ctx context.Context) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -100,19 +134,40 @@ func (i *BatchIngester) Flush(ctx context.Context) error {
 		return nil
 	}
 
-	span, ctx := opentracing.StartSpanFromContext(ctx, "Flush")
-	defer span.Finish()
+	ctx, span := i.Client.tracer().Start(ctx, "Flush")
+	defer span.End()
+
+	var events int
+	for _, es := range i.buffer {
+		events += len(es.Events)
+	}
+	metrics.FlushBatchSize.Observe(float64(events))
+	defer prometheus.NewTimer(metrics.FlushDuration).ObserveDuration()
 
-	// POST /api/v1/ingest/humio-structured
 	var body = &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(i.buffer); err != nil {
-		i.buffer = nil // should not be possible, maybe panic instead?
-		return err
+	var endpoint string
+	switch i.Client.IngestAPI {
+	case IngestHEC:
+		endpoint = "/api/v1/ingest/hec"
+		if err := encodeHEC(body, i.buffer); err != nil {
+			i.drop(events) // should not be possible, maybe panic instead?
+			return err
+		}
+	default:
+		endpoint = "/api/v1/ingest/humio-structured"
+		if err := json.NewEncoder(body).Encode(i.buffer); err != nil {
+			i.drop(events) // should not be possible, maybe panic instead?
+			return err
+		}
 	}
 
-	span.LogKV("spans", len(i.buffer), "bytes_encoded", body.Len())
+	span.SetAttributes(
+		attribute.Int("spans", len(i.buffer)),
+		attribute.Int("bytes_encoded", body.Len()),
+		attribute.String("endpoint", endpoint),
+	)
 
-	req, err := http.NewRequest("POST", i.Client.GetBaseURL()+"/api/v1/ingest/humio-structured", body)
+	req, err := http.NewRequest("POST", i.Client.GetBaseURL()+endpoint, body)
 	if err != nil {
 		// log.Printf("JSON: %s", body.String())
 		return err
@@ -126,19 +181,48 @@ func (i *BatchIngester) Flush(ctx context.Context) error {
 	defer resp.Body.Close()
 
 	if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
-		ext.Error.Set(span, true)
+		span.SetStatus(codes.Error, err.Error())
 
 		// Ideally, drop data only on persistent errors, and retry
 		// later on temporary errors. But for now, drop on any error
 		// because it might be difficult to know if humio has consumed
 		// any data or not.
 		// if resp.StatusCode < 500 ...
-		i.buffer = nil
+		i.drop(events)
 
 		return err
 	}
 
 	i.buffer = nil
+	metrics.BufferedEvents.Sub(float64(events))
+	metrics.EventsFlushed.Add(float64(events))
 
 	return nil
 }
+
+// CheckIngestToken verifies that humio accepts the token of the client
+// for ingest, by sending an empty batch.  Nothing is written to the
+// repository, and the ingest metrics are left alone.
+func (c *Client) CheckIngestToken(ctx context.Context) error {
+	req, err := http.NewRequest("POST", c.GetBaseURL()+"/api/v1/ingest/humio-structured", strings.NewReader("[]"))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	resp, closer, err := c.Do(ctx, req)
+	defer closer()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return expectStatus(ctx, resp, http.StatusOK)
+}
+
+// drop discards the buffered events after a failed flush
+func (i *BatchIngester) drop(events int) {
+	i.buffer = nil
+	metrics.BufferedEvents.Sub(float64(events))
+	metrics.EventsDropped.Add(float64(events))
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/humio/cli/api"
-	"github.com/opentracing-contrib/go-stdlib/nethttp"
 )
 
 func testClient() *api.Client {
@@ -36,8 +35,7 @@ func TestToken(t *testing.T) {
 		BaseURL: "http://localhost:8080",
 		Token:   getIngestToken(),
 		Client: &http.Client{
-			Transport: &nethttp.Transport{},
-			Timeout:   29 * time.Second,
+			Timeout: 29 * time.Second,
 		},
 	}
 
@@ -53,7 +51,7 @@ func TestToken(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		bi.AddEvent(tags, Event{
 			Timestamp: IngestTime{time.Now()},
-			Attributes: map[string]string{
+			Attributes: map[string]interface{}{
 				"@host": "foo",
 				"msg":   fmt.Sprintf("%s i-%d", uniqIDForTest, i),
 			},
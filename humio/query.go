@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Q struct {
@@ -69,12 +71,12 @@ func (c *Client) Query(ctx context.Context, repo string, q Q) (io.ReadCloser, er
 	var body = &bytes.Buffer{}
 	json.NewEncoder(body).Encode(q)
 
-	span := opentracing.SpanFromContext(ctx)
-	if span != nil {
-		span.LogKV("query", body.String())
-		span.LogKV("start", q.Start.String())
-		span.LogKV("end", q.End.String())
-	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("query", body.String()),
+		attribute.String("start", q.Start.String()),
+		attribute.String("end", q.End.String()),
+	)
 
 	req, err := http.NewRequest("POST", c.GetBaseURL()+"/api/v1/repositories/"+repo+"/query", body)
 	if err != nil {
@@ -84,12 +86,10 @@ func (c *Client) Query(ctx context.Context, repo string, q Q) (io.ReadCloser, er
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json") // TODO: Support ndjson too
 
-	resp, closer, err := c.Do(ctx, req)
+	resp, closer, err := c.DoIdempotent(ctx, req)
 	defer closer()
 	if err != nil {
-		if span != nil {
-			ext.Error.Set(span, true)
-		}
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
@@ -102,68 +102,22 @@ func (c *Client) Query(ctx context.Context, repo string, q Q) (io.ReadCloser, er
 
 // QueryJobsSync performs a query as a job and returns the response body stream
 // Use this for streaming responses, for smaller requests see QueryDecode
-// Caller must .Close() the returned reader
+// Caller must .Close() the returned reader.  Partial results are
+// returned one second before the deadline of ctx, or after 15 seconds
+// if ctx has no deadline.
 func (c *Client) QueryJobsSync(ctx context.Context, repo string, q Q) (io.ReadCloser, error) {
+	resp, _, err := c.QueryJobsSyncMeta(ctx, repo, q)
+	return resp, err
+}
 
-	var body = &bytes.Buffer{}
-	err := json.NewEncoder(body).Encode(q)
-	if err != nil {
-		return nil, err
-	}
-
-	span := opentracing.SpanFromContext(ctx)
-	if span != nil {
-		span.LogKV("query", body.String())
-	}
-
-	req, err := http.NewRequest("POST", c.GetBaseURL()+"/api/v1/repositories/"+repo+"/queryjobs", body)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json") // TODO: Support ndjson too
-	resp, closer, err := c.Do(ctx, req)
+// QueryJobsSyncMeta is like QueryJobsSync, but also returns metadata
+// telling if the results are partial, and any warnings from humio.
+func (c *Client) QueryJobsSyncMeta(ctx context.Context, repo string, q Q) (io.ReadCloser, *QueryMetadata, error) {
+	job, err := c.StartQueryJob(ctx, repo, q)
 	if err != nil {
-		closer()
-		return nil, err
-	}
-
-	if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
-		closer()
-		return nil, err
-	}
-
-	var idMap map[string]string
-	if err := json.NewDecoder(resp.Body).Decode(&idMap); err != nil {
-		closer()
-		return nil, err
+		return nil, nil, err
 	}
-	resp.Body.Close()
-	closer()
-
-	id := idMap["id"]
-
-	defer func() {
-		req, err := http.NewRequest("DELETE", c.GetBaseURL()+"/api/v1/repositories/"+repo+"/queryjobs/"+id, nil)
-		if err != nil {
-			// log.Println(err)
-			return
-		}
-
-		resp, closer, err := c.Do(ctx, req)
-		defer closer()
-		if err != nil {
-			// log.Println(err)
-			return
-		}
-
-		if err := expectStatus(ctx, resp, http.StatusOK, http.StatusNoContent); err != nil {
-			// log.Printf("query delete: %v", err)
-		}
-
-		resp.Body.Close()
-	}()
+	defer job.Cancel()
 
 	deadline, ok := ctx.Deadline()
 	if ok {
@@ -174,82 +128,28 @@ func (c *Client) QueryJobsSync(ctx context.Context, repo string, q Q) (io.ReadCl
 		deadline = time.Now().Add(15 * time.Second)
 	}
 
-	var partialEvents []byte
-
-	for time.Now().Before(deadline) {
-		// TODO extract function to clean up closer() + resp.Body.Close()
-		req, err := http.NewRequest("GET", c.GetBaseURL()+"/api/v1/repositories/"+repo+"/queryjobs/"+id, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("Accept", "application/json") // TODO: Support ndjson too
-		resp, closer, err := c.Do(ctx, req)
-		if err != nil {
-			closer()
-			return nil, err
-		}
-
-		if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
-			closer()
-			return nil, err
-		}
+	pollCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
 
-		var status struct {
-			Done     bool            `json:"done"`
-			Events   json.RawMessage `json:"events"`
-			Metadata struct {
-				// isAggregate      bool     `json:"isAggregate"`
-				PollAfter       int `json:"pollAfter"`
-				ProcessedBytes  int `json:"processedBytes"`
-				ProcessedEvents int `json:"processedEvents"`
-				// queryEnd         int      `json:"queryEnd"`
-				// queryStart       int      `json:"queryStart"`
-				// resultBufferSize int      `json:"resultBufferSize"`
-				// timeMillis       int      `json:"timeMillis"`
-				TotalWork int `json:"totalWork"`
-				//warnings         []string `json:"warnings"`
-				WorkDone int `json:"workDone"`
-			} `json:"metaData"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-			closer()
-			return nil, err
-		}
-		resp.Body.Close()
-		closer()
-
-		span := opentracing.SpanFromContext(ctx)
-		if span != nil {
-			span.LogKV("PollAfter", status.Metadata.PollAfter,
-				"ProcessedBytes", status.Metadata.ProcessedBytes,
-				"ProcessedEvents", status.Metadata.ProcessedEvents,
-				"TotalWork", status.Metadata.TotalWork,
-				"WorkDone", status.Metadata.WorkDone,
-			)
+	status, err := job.Results(pollCtx)
+	if err != nil {
+		// The caller gave up, don't bother with partial results
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
 		}
 
-		if status.Done {
-			return io.NopCloser(bytes.NewReader(status.Events)), nil
+		// deadline close, return what we got
+		if errors.Is(err, context.DeadlineExceeded) && status != nil && len(status.Events) != 0 {
+			return io.NopCloser(bytes.NewReader(status.Events)), status.metadata(), nil
 		}
 
-		partialEvents = []byte(status.Events)
-
-		pollAfter := 1000
-
-		if status.Metadata.PollAfter >= 10 {
-			pollAfter = status.Metadata.PollAfter
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("query job returned no results before the deadline: %w", err)
 		}
-		time.Sleep(time.Duration(pollAfter) * time.Millisecond)
-	}
-
-	// deadline close, return what we got
-	if len(partialEvents) != 0 {
-		return io.NopCloser(bytes.NewReader(partialEvents)), nil
+		return nil, nil, err
 	}
 
-	return nil, fmt.Errorf("timeout")
+	return io.NopCloser(bytes.NewReader(status.Events)), status.metadata(), nil
 }
 
 // QueryDecode perform a single query decodes the complete JSON
@@ -257,9 +157,8 @@ func (c *Client) QueryJobsSync(ctx context.Context, repo string, q Q) (io.ReadCl
 // decoded and held in memory.  Caller must .Close() the returned
 // reader. For streaming, see the Query method
 func (c *Client) QueryDecode(ctx context.Context, repo string, q Q, ret interface{}) error {
-	// In humio 1.8.9, "join" is not implemented by a single-request /query, only /queryjobs
 	var queryFunc = c.Query
-	if strings.Contains(q.QueryString, "join") {
+	if c.useQueryJobs(q) {
 		queryFunc = c.QueryJobsSync
 	}
 
@@ -276,6 +175,35 @@ func (c *Client) QueryDecode(ctx context.Context, repo string, q Q, ret interfac
 	return nil
 }
 
+// QueryDecodeMeta is like QueryDecode, but also returns metadata about
+// partial results and warnings when the query runs as a job.  The
+// metadata is nil with the synchronous query API, which returns
+// complete results or an error.
+func (c *Client) QueryDecodeMeta(ctx context.Context, repo string, q Q, ret interface{}) (*QueryMetadata, error) {
+	if !c.useQueryJobs(q) {
+		return nil, c.QueryDecode(ctx, repo, q, ret)
+	}
+
+	resp, meta, err := c.QueryJobsSyncMeta(ctx, repo, q)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	if err := json.NewDecoder(resp).Decode(&ret); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// useQueryJobs returns true if q must run as a query job, according
+// to c.QueryAPI.  In humio 1.8.9, "join" is not implemented by a
+// single-request /query, only /queryjobs.
+func (c *Client) useQueryJobs(q Q) bool {
+	return c.QueryAPI == QueryJobs || strings.Contains(q.QueryString, "join")
+}
+
 func EscapeFieldFilter(s string) string {
 	var buf bytes.Buffer
 	for _, char := range s {
@@ -288,9 +216,9 @@ func EscapeFieldFilter(s string) string {
 	return buf.String()
 }
 
-// expectStatus returns an error with an excerpt of the payload if the
-// HTTP status was not in the expected list of status codes. The body
-// is closed.
+// expectStatus returns an *APIError with an excerpt of the payload if
+// the HTTP status was not in the expected list of status codes. The
+// body is closed.
 func expectStatus(ctx context.Context, resp *http.Response, statusCodes ...int) error {
 	for _, code := range statusCodes {
 		if resp.StatusCode == code {
@@ -303,11 +231,10 @@ func expectStatus(ctx context.Context, resp *http.Response, statusCodes ...int)
 	io.Copy(io.Discard, resp.Body)
 	resp.Body.Close()
 
-	span := opentracing.SpanFromContext(ctx)
-	if span != nil {
-		ext.Error.Set(span, true)
-		span.LogKV("event", buf.String())
-	}
+	err := newAPIError(resp, buf.String())
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, resp.Status)
 
-	return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, buf.String())
+	return err
 }
@@ -0,0 +1,273 @@
+package humio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cancelTimeout bounds the DELETE request made by QueryJob.Cancel,
+// which does not use the (possibly already cancelled) caller context.
+const cancelTimeout = 10 * time.Second
+
+// A QueryJob is a query running asynchronously in humio.  Create it
+// with Client.StartQueryJob, then call Poll or Results to get events,
+// and always Cancel it to free resources in humio when done.
+type QueryJob struct {
+	ID string
+
+	client *Client
+	repo   string
+
+	progressMu sync.Mutex
+	progress   chan QueryJobStatus
+	finished   bool
+
+	cancelOnce sync.Once
+	cancelErr  error
+}
+
+// QueryJobStatus is the result of polling a QueryJob.  Until Done,
+// Events holds the partial results so far.
+type QueryJobStatus struct {
+	Done      bool            `json:"done"`
+	Cancelled bool            `json:"cancelled"`
+	Events    json.RawMessage `json:"events"`
+	Metadata  struct {
+		PollAfter       int      `json:"pollAfter"` // milliseconds
+		ProcessedBytes  int      `json:"processedBytes"`
+		ProcessedEvents int      `json:"processedEvents"`
+		TotalWork       int      `json:"totalWork"`
+		WorkDone        int      `json:"workDone"`
+		Warnings        []string `json:"warnings"`
+	} `json:"metaData"`
+}
+
+// QueryMetadata tells how complete the results of a query are
+type QueryMetadata struct {
+	Done            bool // false if only partial results were returned
+	ProcessedEvents int
+	WorkDone        int
+	TotalWork       int
+	Warnings        []string // from humio
+}
+
+func (s *QueryJobStatus) metadata() *QueryMetadata {
+	return &QueryMetadata{
+		Done:            s.Done,
+		ProcessedEvents: s.Metadata.ProcessedEvents,
+		WorkDone:        s.Metadata.WorkDone,
+		TotalWork:       s.Metadata.TotalWork,
+		Warnings:        s.Metadata.Warnings,
+	}
+}
+
+// pollAfter returns how long to wait before polling again, as
+// suggested by humio
+func (s *QueryJobStatus) pollAfter() time.Duration {
+	if s.Metadata.PollAfter >= 10 {
+		return time.Duration(s.Metadata.PollAfter) * time.Millisecond
+	}
+	return time.Second
+}
+
+// StartQueryJob starts the query as a job in humio and returns
+// without waiting for results.  It is retried when humio is overloaded,
+// but not after transport errors, as a retry after a lost response
+// would start a second job which is never cancelled.
+func (c *Client) StartQueryJob(ctx context.Context, repo string, q Q) (*QueryJob, error) {
+	var body = &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(q); err != nil {
+		return nil, err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("query", body.String()))
+
+	req, err := http.NewRequest("POST", c.GetBaseURL()+"/api/v1/repositories/"+repo+"/queryjobs", body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	resp, closer, err := c.DoUnlessSent(ctx, req)
+	defer closer()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var idMap map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&idMap); err != nil {
+		return nil, err
+	}
+
+	return &QueryJob{
+		ID:       idMap["id"],
+		client:   c,
+		repo:     repo,
+		progress: make(chan QueryJobStatus, 1),
+	}, nil
+}
+
+func (j *QueryJob) url() string {
+	return j.client.GetBaseURL() + "/api/v1/repositories/" + j.repo + "/queryjobs/" + j.ID
+}
+
+// Poll fetches the current status and (partial) results of the job
+// once.  The status is also published on the Progress channel.
+func (j *QueryJob) Poll(ctx context.Context) (*QueryJobStatus, error) {
+	req, err := http.NewRequest("GET", j.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	resp, closer, err := j.client.DoIdempotent(ctx, req)
+	defer closer()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status QueryJobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("poll", trace.WithAttributes(
+		attribute.Int("PollAfter", status.Metadata.PollAfter),
+		attribute.Int("ProcessedBytes", status.Metadata.ProcessedBytes),
+		attribute.Int("ProcessedEvents", status.Metadata.ProcessedEvents),
+		attribute.Int("TotalWork", status.Metadata.TotalWork),
+		attribute.Int("WorkDone", status.Metadata.WorkDone),
+	))
+
+	j.publish(status)
+	return &status, nil
+}
+
+// publish replaces any unread status on the progress channel, and
+// closes it when the job is finished
+func (j *QueryJob) publish(status QueryJobStatus) {
+	j.progressMu.Lock()
+	defer j.progressMu.Unlock()
+
+	if j.finished {
+		return
+	}
+
+	select {
+	case <-j.progress:
+	default:
+	}
+	j.progress <- status
+
+	if status.Done || status.Cancelled {
+		j.finish()
+	}
+}
+
+// finish closes the progress channel. Caller must hold progressMu.
+func (j *QueryJob) finish() {
+	if !j.finished {
+		j.finished = true
+		close(j.progress)
+	}
+}
+
+// Progress returns a channel with the latest status seen by Poll or
+// Results.  Only the most recent status is kept if the reader falls
+// behind.  The channel is closed when the job is done or cancelled.
+func (j *QueryJob) Progress() <-chan QueryJobStatus {
+	return j.progress
+}
+
+// Results polls the job until it is done and returns the final
+// status.  If ctx is done first, the last partial status seen (which
+// may be nil) is returned together with the context error.
+func (j *QueryJob) Results(ctx context.Context) (*QueryJobStatus, error) {
+	var last *QueryJobStatus
+	for {
+		status, err := j.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return last, ctx.Err()
+			}
+			return nil, err
+		}
+
+		if status.Cancelled {
+			return nil, fmt.Errorf("query job %s was cancelled by humio", j.ID)
+		}
+
+		if status.Done {
+			return status, nil
+		}
+		last = status
+
+		timer := time.NewTimer(status.pollAfter())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return last, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Cancel stops the job in humio.  It uses a context of its own, so
+// it works even when the context used to start or poll the job has
+// been cancelled.  It is safe to call Cancel more than once.
+func (j *QueryJob) Cancel() error {
+	j.cancelOnce.Do(func() {
+		defer func() {
+			if j.cancelErr != nil {
+				j.client.logger().Debug("Deleting query job failed", "id", j.ID, "err", j.cancelErr)
+			}
+		}()
+
+		j.progressMu.Lock()
+		j.finish()
+		j.progressMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+
+		req, err := http.NewRequest("DELETE", j.url(), nil)
+		if err != nil {
+			j.cancelErr = err
+			return
+		}
+
+		resp, closer, err := j.client.DoIdempotent(ctx, req)
+		defer closer()
+		if err != nil {
+			j.cancelErr = err
+			return
+		}
+
+		if err := expectStatus(ctx, resp, http.StatusOK, http.StatusNoContent); err != nil {
+			j.cancelErr = err
+			return
+		}
+		resp.Body.Close()
+	})
+
+	return j.cancelErr
+}
@@ -0,0 +1,252 @@
+package humio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeQueryJobs serves the humio queryjobs API, reporting the job as
+// done after the given number of polls (never if 0)
+type fakeQueryJobs struct {
+	mu      sync.Mutex
+	polls   int
+	doneAt  int
+	deleted bool
+}
+
+func (f *fakeQueryJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case "POST":
+		json.NewEncoder(w).Encode(map[string]string{"id": "job1"})
+	case "GET":
+		f.polls++
+		done := f.doneAt != 0 && f.polls >= f.doneAt
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"done":     done,
+			"events":   []map[string]int{{"poll": f.polls}},
+			"metaData": map[string]interface{}{"pollAfter": 10, "workDone": f.polls, "totalWork": 3, "warnings": []string{"slow"}},
+		})
+	case "DELETE":
+		f.deleted = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestQueryJobResults(t *testing.T) {
+	fake := &fakeQueryJobs{doneAt: 3}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	job, err := c.StartQueryJob(context.Background(), "sandbox", Q{QueryString: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := job.Results(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !status.Done || string(status.Events) != `[{"poll":3}]` {
+		t.Errorf("unexpected final status %+v", status)
+	}
+
+	var last QueryJobStatus
+	for s := range job.Progress() {
+		last = s
+	}
+	if !last.Done {
+		t.Errorf("expected the last progress update to be done, got %+v", last)
+	}
+
+	if err := job.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.deleted {
+		t.Error("job was not deleted")
+	}
+}
+
+func TestStartQueryJobRetriesOverload(t *testing.T) {
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": "job1"})
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, &Backoff{Initial: time.Millisecond})
+	job, err := c.StartQueryJob(context.Background(), "sandbox", Q{QueryString: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.ID != "job1" {
+		t.Errorf("got job %q, want job1", job.ID)
+	}
+	if posts := atomic.LoadInt32(&posts); posts != 2 {
+		t.Errorf("got %d requests, want 2", posts)
+	}
+}
+
+func TestStartQueryJobNotRetriedAfterLostResponse(t *testing.T) {
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		// the job may have been started, but the response is lost
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, &Backoff{Initial: time.Millisecond})
+	if _, err := c.StartQueryJob(context.Background(), "sandbox", Q{QueryString: "*"}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if posts := atomic.LoadInt32(&posts); posts != 1 {
+		t.Errorf("got %d requests, want 1", posts)
+	}
+}
+
+func TestQueryJobCancelledContext(t *testing.T) {
+	fake := &fakeQueryJobs{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	job, err := c.StartQueryJob(context.Background(), "sandbox", Q{QueryString: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	status, err := job.Results(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if status == nil || len(status.Events) == 0 {
+		t.Error("expected partial results")
+	}
+
+	// Cancel must work with the context already expired
+	if err := job.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.deleted {
+		t.Error("job was not deleted")
+	}
+
+	if _, open := <-job.Progress(); open {
+		// drain the last buffered update
+		if _, open := <-job.Progress(); open {
+			t.Error("progress channel not closed after Cancel")
+		}
+	}
+}
+
+func TestQueryJobsSyncPartialResults(t *testing.T) {
+	fake := &fakeQueryJobs{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	c.QueryAPI = QueryJobs
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+
+	var events []map[string]int
+	meta, err := c.QueryDecodeMeta(ctx, "sandbox", Q{QueryString: "*"}, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Done || meta.TotalWork != 3 || len(meta.Warnings) != 1 {
+		t.Errorf("unexpected metadata for partial results %+v", meta)
+	}
+
+	if len(events) != 1 || events[0]["poll"] == 0 {
+		t.Errorf("unexpected partial events %v", events)
+	}
+
+	if !fake.deleted {
+		t.Error("job was not deleted")
+	}
+}
+
+func TestQueryJobsSyncTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			json.NewEncoder(w).Encode(map[string]string{"id": "job1"})
+		case "GET":
+			// humio is too slow to answer the first poll
+			<-r.Context().Done()
+		case "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	c.QueryAPI = QueryJobs
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+
+	var events []map[string]int
+	_, err := c.QueryDecodeMeta(ctx, "sandbox", Q{QueryString: "*"}, &events)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("expected the error before the deadline of the caller")
+	}
+}
+
+func TestQueryDecodeMetaSync(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repositories/sandbox/query" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`[{"poll":1}]`))
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	c.QueryAPI = QuerySync
+
+	var events []map[string]int
+	meta, err := c.QueryDecodeMeta(context.Background(), "sandbox", Q{QueryString: "*"}, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta != nil {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+
+	if len(events) != 1 {
+		t.Errorf("unexpected events %v", events)
+	}
+}
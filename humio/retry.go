@@ -0,0 +1,187 @@
+package humio
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A RetryPolicy decides if and when a request made with
+// Client.DoIdempotent or Client.DoUnlessSent should be retried.
+type RetryPolicy interface {
+	// Backoff is called after each failed attempt (starting at 1)
+	// with the response or error from that attempt, and the time
+	// elapsed since the first attempt. It returns how long to wait
+	// before the next attempt, or false to give up.
+	Backoff(attempt int, elapsed time.Duration, resp *http.Response, err error) (time.Duration, bool)
+}
+
+// Backoff is a RetryPolicy with exponential backoff and jitter,
+// which honours the Retry-After header from humio. Zero values are
+// replaced by sensible defaults.
+type Backoff struct {
+	MaxAttempts int           // default 5
+	Initial     time.Duration // default 250ms
+	Max         time.Duration // default 10s
+	MaxElapsed  time.Duration // default 30s
+}
+
+func (b *Backoff) Backoff(attempt int, elapsed time.Duration, resp *http.Response, err error) (time.Duration, bool) {
+	maxAttempts, initial, max, maxElapsed := b.MaxAttempts, b.Initial, b.Max, b.MaxElapsed
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+	if initial == 0 {
+		initial = 250 * time.Millisecond
+	}
+	if max == 0 {
+		max = 10 * time.Second
+	}
+	if maxElapsed == 0 {
+		maxElapsed = 30 * time.Second
+	}
+
+	if attempt >= maxAttempts || !retryable(resp, err) {
+		return 0, false
+	}
+
+	wait, ok := retryAfter(resp)
+	if !ok {
+		wait = initial << (attempt - 1)
+		if wait > max || wait <= 0 {
+			wait = max
+		}
+		// full jitter, to spread out clients hitting an overloaded humio
+		wait = time.Duration(rand.Int63n(int64(wait)) + 1)
+	}
+
+	if elapsed+wait > maxElapsed {
+		return 0, false
+	}
+
+	return wait, true
+}
+
+// retryable returns true for transport errors and HTTP statuses
+// which signal that humio is overloaded or temporarily unavailable.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return IsRetryable(err)
+	}
+	return retryableStatus(resp.StatusCode)
+}
+
+// retryAfter parses the Retry-After header, which is either a number
+// of seconds or a HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+// DoIdempotent performs the request like Do, but retries according to
+// c.Retry on transport errors, 429 and 503 responses.  Only use it for
+// requests which are safe to repeat, such as queries, polls and
+// deletes.  Retries never wait beyond the deadline of ctx.
+func (c *Client) DoIdempotent(ctx context.Context, req *http.Request) (*http.Response, func(), error) {
+	return c.doRetry(ctx, req, c.Retry)
+}
+
+// DoUnlessSent performs the request like Do, but retries according to
+// c.Retry on 429, 502, 503 and 504 responses, as humio, or the proxy
+// in front of it, rejects the request without acting on it.  Transport
+// errors are not retried, as the request may have reached humio before
+// the connection was lost.  Use it for requests which are not safe to
+// repeat, such as starting query jobs.
+func (c *Client) DoUnlessSent(ctx context.Context, req *http.Request) (*http.Response, func(), error) {
+	if c.Retry == nil {
+		return c.Do(ctx, req)
+	}
+	return c.doRetry(ctx, req, statusRetry{c.Retry})
+}
+
+// statusRetry is a RetryPolicy which only retries responses, and gives
+// up on transport errors
+type statusRetry struct {
+	RetryPolicy
+}
+
+func (p statusRetry) Backoff(attempt int, elapsed time.Duration, resp *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		return 0, false
+	}
+	return p.RetryPolicy.Backoff(attempt, elapsed, resp, err)
+}
+
+// doRetry performs the request, retrying according to policy
+func (c *Client) doRetry(ctx context.Context, req *http.Request, policy RetryPolicy) (*http.Response, func(), error) {
+	if policy == nil || (req.Body != nil && req.GetBody == nil) {
+		return c.Do(ctx, req)
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, closer, err := c.Do(ctx, req)
+		if err == nil && !retryable(resp, nil) {
+			return resp, closer, nil
+		}
+
+		wait, retry := policy.Backoff(attempt, time.Since(start), resp, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			retry = false
+		}
+		if !retry {
+			return resp, closer, err
+		}
+
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		c.logger().Debug("Retrying request", "method", req.Method, "path", req.URL.Path, "attempt", attempt, "status", status, "err", err, "wait", wait)
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		closer()
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, func() {}, err
+			}
+			req.Body = body
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, func() {}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package humio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testServerClient(url string, retry RetryPolicy) *Client {
+	return &Client{
+		BaseURL: url,
+		Client:  &http.Client{},
+		Retry:   retry,
+	}
+}
+
+func TestDoIdempotentRetriesOverload(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 100)
+		n, _ := r.Body.Read(buf)
+		if string(buf[:n]) != "query" {
+			t.Errorf("body not replayed on retry: %q", buf[:n])
+		}
+
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, &Backoff{Initial: time.Millisecond})
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, closer, err := c.DoIdempotent(context.Background(), req)
+	defer closer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
+
+func TestDoIdempotentGivesUp(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, &Backoff{MaxAttempts: 3, Initial: time.Millisecond})
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, closer, err := c.DoIdempotent(context.Background(), req)
+	defer closer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", resp.StatusCode)
+	}
+
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
+
+func TestBackoffRetryAfterBeyondBudget(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"60"}},
+	}
+
+	b := &Backoff{MaxElapsed: 10 * time.Second}
+	if _, retry := b.Backoff(1, 0, resp, nil); retry {
+		t.Error("expected to give up when Retry-After exceeds the budget")
+	}
+}
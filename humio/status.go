@@ -0,0 +1,118 @@
+package humio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IngestAPI selects the endpoint used by BatchIngester
+type IngestAPI string
+
+const (
+	// IngestStructured is /api/v1/ingest/humio-structured, which
+	// is supported by all versions of humio
+	IngestStructured IngestAPI = "humio-structured"
+	// IngestHEC is the Splunk HTTP Event Collector compatible
+	// /api/v1/ingest/hec, preferred by LogScale
+	IngestHEC IngestAPI = "hec"
+)
+
+// QueryAPI selects the endpoint used by QueryDecode
+type QueryAPI string
+
+const (
+	// QuerySync uses the synchronous /query endpoint, except for
+	// queries with join, which are run as query jobs
+	QuerySync QueryAPI = "query"
+	// QueryJobs runs all queries as query jobs
+	QueryJobs QueryAPI = "queryjobs"
+)
+
+// logScaleMinor is the first 1.x release branded Falcon LogScale
+const logScaleMinor = 60
+
+// ServerStatus is the response from the status endpoint
+type ServerStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
+// LogScale returns true if the server is a Falcon LogScale (and not
+// a legacy humio) release.
+func (s *ServerStatus) LogScale() bool {
+	// The version looks like "1.18.4--build-123--sha-abcdef"
+	version := strings.SplitN(s.Version, "-", 2)[0]
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return major > 1 || (major == 1 && minor >= logScaleMinor)
+}
+
+// Status fetches the version and status of the server
+func (c *Client) Status(ctx context.Context) (*ServerStatus, error) {
+	req, err := http.NewRequest("GET", c.GetBaseURL()+"/api/v1/status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	resp, closer, err := c.DoIdempotent(ctx, req)
+	defer closer()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectStatus(ctx, resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status ServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decoding status: %w", err)
+	}
+
+	return &status, nil
+}
+
+// Detect selects the best ingest and query endpoints for the server
+// version, unless IngestAPI or QueryAPI are already set.  Call it
+// before making copies of the client.
+func (c *Client) Detect(ctx context.Context) (*ServerStatus, error) {
+	status, err := c.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.IngestAPI == "" {
+		c.IngestAPI = IngestStructured
+		if status.LogScale() {
+			c.IngestAPI = IngestHEC
+		}
+	}
+
+	if c.QueryAPI == "" {
+		c.QueryAPI = QuerySync
+		if status.LogScale() {
+			c.QueryAPI = QueryJobs
+		}
+	}
+
+	return status, nil
+}
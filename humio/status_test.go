@@ -0,0 +1,70 @@
+package humio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerStatusLogScale(t *testing.T) {
+	for version, want := range map[string]bool{
+		"1.18.4--build-123--sha-abcdef": false,
+		"1.59.0":                        false,
+		"1.60.0--build-1":               true,
+		"1.100.2":                       true,
+		"2.0.0":                         true,
+		"":                              false,
+	} {
+		s := &ServerStatus{Version: version}
+		if got := s.LogScale(); got != want {
+			t.Errorf("LogScale() for %q = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/status" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(ServerStatus{Status: "OK", Version: "1.70.0--build-1"})
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	c.QueryAPI = QuerySync // configured override
+	if _, err := c.Detect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.IngestAPI != IngestHEC {
+		t.Errorf("got ingest API %q, want %q", c.IngestAPI, IngestHEC)
+	}
+
+	if c.QueryAPI != QuerySync {
+		t.Errorf("override of query API not respected, got %q", c.QueryAPI)
+	}
+}
+
+func TestEncodeHEC(t *testing.T) {
+	var buf bytes.Buffer
+	err := encodeHEC(&buf, []eventStream{{
+		Tags: map[string]string{"kind": "test"},
+		Events: []Event{{
+			Timestamp:  IngestTime{time.Unix(1600000000, 500000000)},
+			Attributes: map[string]interface{}{"msg": "hello"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"time":1600000000.5,"event":{"msg":"hello"},"fields":{"kind":"test"}}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
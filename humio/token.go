@@ -0,0 +1,59 @@
+package humio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A TokenSource provides the token used for each request, so tokens
+// can be rotated without restarting.  See Client.TokenSource.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource which never changes
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// FileToken is a TokenSource reading the token from a file, such as a
+// kubernetes secret mounted as a volume.  The file is read again when
+// its modification time changes.
+type FileToken struct {
+	reloader fileReloader
+}
+
+// NewFileToken returns a FileToken for the path, and fails if the
+// file cannot be read or is empty
+func NewFileToken(path string) (*FileToken, error) {
+	t := &FileToken{reloader: fileReloader{paths: []string{path}, load: loadToken}}
+	if _, err := t.Token(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *FileToken) Token() (string, error) {
+	token, err := t.reloader.get()
+	if err != nil {
+		return "", err
+	}
+	return token.(string), nil
+}
+
+func loadToken(paths []string) (interface{}, error) {
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("loading token: %w", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, errors.New("token file " + paths[0] + " is empty")
+	}
+	return token, nil
+}
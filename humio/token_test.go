@@ -0,0 +1,71 @@
+package humio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTokenRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewFileToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	c := testServerClient(srv.URL, nil)
+	c.TokenSource = token
+
+	get := func() {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		resp, closer, err := c.Do(context.Background(), req)
+		defer closer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	if got != "Bearer first" {
+		t.Errorf("got %q, want the first token", got)
+	}
+
+	if err := os.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	get()
+	if got != "Bearer second" {
+		t.Errorf("got %q, want the rotated token", got)
+	}
+}
+
+func TestFileTokenEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileToken(path); err == nil {
+		t.Error("expected error for empty token file")
+	}
+}
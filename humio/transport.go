@@ -0,0 +1,255 @@
+package humio
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TransportConfig configures the HTTP transport used to talk to
+// humio, see NewTransport.  Certificate and CA files are re-read when
+// they change, so they can be rotated without a restart.
+type TransportConfig struct {
+	CAFile             string // PEM bundle of CAs trusted in addition to the system pool
+	CertFile           string // PEM client certificate for mTLS
+	KeyFile            string // PEM key for CertFile
+	InsecureSkipVerify bool   // only for labs, disables server certificate verification
+	ProxyURL           string // defaults to HTTPS_PROXY etc. from the environment
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+}
+
+// NewTransport creates a http.RoundTripper from the configuration
+func NewTransport(cfg TransportConfig) (http.RoundTripper, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("both or none of the client certificate and key files must be given")
+	}
+
+	var certs *fileReloader
+	if cfg.CertFile != "" {
+		certs = &fileReloader{paths: []string{cfg.CertFile, cfg.KeyFile}, load: loadKeyPair}
+		if _, err := certs.get(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.CAFile == "" || cfg.InsecureSkipVerify {
+		transport, err := newTransport(cfg, certs, nil)
+		if err != nil {
+			return nil, err
+		}
+		return transport, nil
+	}
+
+	rt := &caReloadingTransport{
+		cfg:   cfg,
+		certs: certs,
+		cas:   &fileReloader{paths: []string{cfg.CAFile}, load: loadCertPool},
+	}
+	if _, err := rt.transport(); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+func newTransport(cfg TransportConfig, certs *fileReloader, rootCAs *x509.CertPool) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		RootCAs:            rootCAs,
+	}
+
+	if certs != nil {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := certs.get()
+			if err != nil {
+				return nil, err
+			}
+			return cert.(*tls.Certificate), nil
+		}
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+	}, nil
+}
+
+// caReloadingTransport replaces the underlying transport when the CA
+// file changes, as the root CAs of a transport cannot be changed
+// after use.
+type caReloadingTransport struct {
+	cfg   TransportConfig
+	certs *fileReloader
+	cas   *fileReloader
+
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	current *http.Transport
+}
+
+func (t *caReloadingTransport) transport() (*http.Transport, error) {
+	pool, err := t.cas.get()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pool.(*x509.CertPool) == t.pool {
+		return t.current, nil
+	}
+
+	transport, err := newTransport(t.cfg, t.certs, pool.(*x509.CertPool))
+	if err != nil {
+		return nil, err
+	}
+
+	if t.current != nil {
+		t.current.CloseIdleConnections()
+	}
+	t.pool, t.current = pool.(*x509.CertPool), transport
+	return transport, nil
+}
+
+func (t *caReloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := t.transport()
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+func (t *caReloadingTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.CloseIdleConnections()
+	}
+}
+
+// NewServerTLSConfig returns a TLS config for a server with the
+// certificate and key in PEM files, which are re-read when they change
+// like the files of TransportConfig
+func NewServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	certs := &fileReloader{paths: []string{certFile, keyFile}, load: loadKeyPair}
+	if _, err := certs.get(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := certs.get()
+			if err != nil {
+				return nil, err
+			}
+			return cert.(*tls.Certificate), nil
+		},
+	}, nil
+}
+
+func loadKeyPair(paths []string) (interface{}, error) {
+	cert, err := tls.LoadX509KeyPair(paths[0], paths[1])
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+func loadCertPool(paths []string) (interface{}, error) {
+	pem, err := os.ReadFile(paths[0])
+	if err != nil {
+		return nil, fmt.Errorf("loading CA file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", paths[0])
+	}
+	return pool, nil
+}
+
+// fileReloader caches the result of load, and calls it again when the
+// modification time of any of the files change.  If reloading fails,
+// for example while a secret is being rotated, the previous value is
+// kept.
+type fileReloader struct {
+	paths []string
+	load  func(paths []string) (interface{}, error)
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	value    interface{}
+}
+
+func (r *fileReloader) get() (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := make([]time.Time, len(r.paths))
+	changed := r.value == nil
+	for i, path := range r.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if r.value != nil {
+				return r.value, nil
+			}
+			return nil, err
+		}
+		modTimes[i] = fi.ModTime()
+		if r.modTimes == nil || !r.modTimes[i].Equal(modTimes[i]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return r.value, nil
+	}
+
+	value, err := r.load(r.paths)
+	if err != nil {
+		if r.value != nil {
+			return r.value, nil
+		}
+		return nil, err
+	}
+
+	r.value, r.modTimes = value, modTimes
+	return value, nil
+}
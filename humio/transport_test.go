@@ -0,0 +1,97 @@
+package humio
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCA(t *testing.T, path string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// selfSignedCA creates an unrelated CA certificate
+func selfSignedCA(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestTransportCAFile(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewTLSServer(handler)
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCA(t, caFile, srv.Certificate().Raw)
+
+	transport, err := NewTransport(TransportConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Rotate the CA to one which does not match the server
+	writeCA(t, caFile, selfSignedCA(t))
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("expected certificate error after CA rotation")
+	}
+}
+
+func TestTransportConfigErrors(t *testing.T) {
+	if _, err := NewTransport(TransportConfig{CertFile: "cert.pem"}); err == nil {
+		t.Error("expected error for certificate without key")
+	}
+
+	if _, err := NewTransport(TransportConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+
+	dir := t.TempDir()
+	if _, err := NewServerTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("expected error for missing server certificate")
+	}
+}
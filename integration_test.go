@@ -97,7 +97,7 @@ func TestIntegration(t *testing.T) {
 	pc := PluginConfig{
 		Humio:      "http://localhost:8080",
 		Repo:       "sandbox",
-		ReadToken:  "",
+		ReadToken:  "unused", // the dockerized humio has no authentication
 		WriteToken: getIngestToken(),
 	}
 
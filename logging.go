@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chlunde/humio-jaeger-storage/plugin"
+	"github.com/hashicorp/go-hclog"
+)
+
+// newLogger creates the logger from the logLevel and logFormat fields
+// of the config, which may be nil to get the defaults.  Our
+// stdout/stderr is not propagated to the user, so be sure to use this
+// for important messages
+func newLogger(config *PluginConfig) hclog.Logger {
+	level, format := "info", "json"
+	if config != nil && config.LogLevel != "" {
+		level = config.LogLevel
+	}
+	if config != nil && config.LogFormat != "" {
+		format = config.LogFormat
+	}
+
+	return hclog.New(&hclog.LoggerOptions{
+		Name:              serviceName,
+		Level:             hclog.LevelFromString(level),
+		JSONFormat:        format == "json",
+		IndependentLevels: true,
+	})
+}
+
+// parseLogLevels parses subsystem levels such as
+// "dependencies=debug,client=trace"
+func parseLogLevels(s string) (map[string]hclog.Level, error) {
+	levels := make(map[string]hclog.Level)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		subsystem, levelStr, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected subsystem=level, got %q", part)
+		}
+
+		if !validSubsystem(subsystem) {
+			return nil, fmt.Errorf("unknown subsystem %q, expected one of %s", subsystem, strings.Join(plugin.Subsystems, ", "))
+		}
+
+		level := hclog.LevelFromString(levelStr)
+		if level == hclog.NoLevel {
+			return nil, fmt.Errorf("unknown log level %q for %s", levelStr, subsystem)
+		}
+		levels[subsystem] = level
+	}
+	return levels, nil
+}
+
+func validSubsystem(name string) bool {
+	for _, s := range plugin.Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,121 +1,274 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/chlunde/humio-jaeger-storage/health"
 	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
 	"github.com/chlunde/humio-jaeger-storage/plugin"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
-	"github.com/opentracing-contrib/go-stdlib/nethttp"
-	"github.com/opentracing/opentracing-go"
-	"github.com/uber/jaeger-client-go/config"
+	googlegrpc "google.golang.org/grpc"
 
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
 )
 
-// PluginConfig is the file format for our config
-// ./plugin -config configuration.json
-type PluginConfig struct {
-	ReadToken  string `json:"readToken"`
-	WriteToken string `json:"writeToken"`
-	Repo       string `json:"repo"`
-	Humio      string `json:"humio"`
-}
-
 const serviceName = "humio-jaeger-storage"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dependencies" {
+		os.Exit(runDependencies(os.Args[2:]))
+	}
+
 	// Parse command line options
 	var configPath string
+	var printConfigOnly bool
+	var serveAddr string
 	flag.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	flag.StringVar(&serveAddr, "serve-addr", "", "Serve jaeger's remote storage gRPC API on this address, such as :17271, instead of running as a plugin")
+	flag.BoolVar(&printConfigOnly, "print-config", false, "Print the effective configuration with secrets redacted, and exit")
 	flag.Parse()
 
-	os.Setenv("JAEGER_REPORTER_FLUSH_INTERVAL", "1s")
-	os.Setenv("JAEGER_SAMPLER_TYPE", "const")
-	os.Setenv("JAEGER_SAMPLER_PARAM", "1")
-	/*
-		os.Setenv("JAEGER_REPORTER_LOG_SPANS", "true")
-	*/
-
-	// Set up logger. Our stdout/stderr is not propagated to the user,
-	// so be sure to use this for important messages
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name:       serviceName,
-		Level:      hclog.Warn,
-		JSONFormat: true,
-	})
-
-	// Attempt to set up jaeger to trace ourself
-	conf, err := config.FromEnv()
-	if err != nil {
-		logger.Warn("Jaeger client config failed", "err", err)
-		conf = &config.Configuration{}
+	if printConfigOnly {
+		os.Exit(printConfig(configPath))
 	}
 
-	conf.ServiceName = serviceName
-	tracer, closer, err := conf.NewTracer(config.Logger(&jaegerTohcLog{inner: logger}))
+	// Parse plugin config with tokens etc., using a default logger
+	// until we know the configured level and format
+	config, err := loadConfig(configPath)
+	if err == nil {
+		if serveAddr != "" {
+			config.ServeAddr = serveAddr
+		}
+		err = config.validate()
+	}
 	if err != nil {
-		logger.Error("Failed to configure jaeger client", "err", err)
+		newLogger(nil).Error("Reading config failed", "path", configPath, "err", err.Error())
 		os.Exit(1)
 	}
 
-	defer closer.Close()
-	opentracing.SetGlobalTracer(tracer)
+	logger := newLogger(config)
+	logger.Debug("Config path", "path", configPath)
 
-	// Parse plugin config with tokens etc.
-	logger.Warn("Config path", "path", configPath)
-	config, err := readConfig(configPath)
+	if config.SelfTracing {
+		shutdown, err := initTracing(config, logger)
+		if err != nil {
+			logger.Error("Failed to configure tracing", "err", err)
+			os.Exit(1)
+		}
+		defer shutdown()
+	}
+
+	plugin, err := newPlugin(config, logger)
 	if err != nil {
-		logger.Error("Reading config failed", "err", err.Error())
+		logger.Error("Configuring plugin failed", "err", err.Error())
 		os.Exit(1)
 	}
 
-	plugin := plugin.HumioPlugin{
-		Logger:     logger,
-		Repo:       config.Repo,
-		ReadToken:  config.ReadToken,
-		WriteToken: config.WriteToken,
-		Humio: &humio.Client{
-			BaseURL: config.Humio,
-			Client: &http.Client{
-				Transport: &nethttp.Transport{},
-				Timeout:   29 * time.Second,
-			},
-		},
+	services := &shared.PluginServices{
+		Store:               plugin,
+		StreamingSpanWriter: plugin,
+	}
+	if config.ArchiveRepo != "" {
+		services.ArchiveStore = plugin
+	}
+	healthChecker := plugin.HealthChecker
+	metricsReader := plugin.MetricsReader
+
+	if len(config.Tenants) > 0 {
+		router, err := newTenantRouter(config, plugin)
+		if err != nil {
+			logger.Error("Configuring tenants failed", "err", err.Error())
+			os.Exit(1)
+		}
+		services = &shared.PluginServices{
+			Store:               router,
+			StreamingSpanWriter: router,
+		}
+		healthChecker = router.HealthChecker
+		metricsReader = router.MetricsReader
+	}
+
+	interval, _ := time.ParseDuration(config.HealthCheckInterval) // validated, zero means default
+	checker := healthChecker(interval)
+	interceptors := []googlegrpc.UnaryServerInterceptor{checker.UnaryServerInterceptor()}
+	go checker.Run(context.Background())
+
+	serveHTTP(config, checker, logger)
+
+	if config.ServeAddr != "" {
+		if err := serveGRPC(config, services, metricsReader(), interceptors, logger); err != nil {
+			logger.Error("Serving gRPC failed", "err", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	grpc.Serve(&shared.PluginServices{
-		Store: &plugin,
+	grpc.ServeWithGRPCServer(services, func(opts []googlegrpc.ServerOption) *googlegrpc.Server {
+		return googlegrpc.NewServer(append(opts, googlegrpc.ChainUnaryInterceptor(interceptors...))...)
 	})
 }
 
-func readConfig(path string) (*PluginConfig, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// serveHTTP serves metrics and health probes on the configured
+// addresses, sharing the listener if the addresses are the same
+func serveHTTP(config *PluginConfig, checker *health.Checker, logger hclog.Logger) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
 	}
 
-	var pluginConfig PluginConfig
-	return &pluginConfig, json.Unmarshal(data, &pluginConfig)
-}
+	if config.MetricsAddr != "" {
+		mux(config.MetricsAddr).Handle("/metrics", metrics.Handler())
+	}
 
-// jaegerTohclog makes a hashicorp logger implement the jaeger logger interface
-type jaegerTohcLog struct {
-	inner hclog.Logger
+	if config.HealthAddr != "" {
+		mux(config.HealthAddr).Handle("/healthz", checker.LiveHandler())
+		mux(config.HealthAddr).Handle("/readyz", checker.ReadyHandler())
+	}
+
+	for addr, m := range muxes {
+		go func(addr string, m *http.ServeMux) {
+			logger.Info("Serving HTTP", "addr", addr)
+			if err := http.ListenAndServe(addr, m); err != nil {
+				logger.Error("Serving HTTP failed", "addr", addr, "err", err)
+			}
+		}(addr, m)
+	}
 }
 
-// Error logs a message at error priority
-func (j jaegerTohcLog) Error(msg string) {
-	j.inner.Error(msg)
+// newTenantRouter creates a plugin per tenant, sharing the humio
+// client and settings of base
+func newTenantRouter(config *PluginConfig, base *plugin.HumioPlugin) (*plugin.TenantRouter, error) {
+	router := &plugin.TenantRouter{
+		Tenants: make(map[string]*plugin.HumioPlugin, len(config.Tenants)),
+		Header:  config.TenantHeader,
+	}
+
+	for name, tenant := range config.Tenants {
+		readToken, err := tokenSource(tenant.ReadToken, tenant.ReadTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+
+		writeToken, err := tokenSource(tenant.WriteToken, tenant.WriteTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+
+		router.Tenants[name] = &plugin.HumioPlugin{
+			Logger:                  base.Logger.With("tenant", name),
+			Repo:                    tenant.Repo,
+			ReadToken:               readToken,
+			WriteToken:              writeToken,
+			PrecomputedDependencies: base.PrecomputedDependencies,
+			SchemaVersion:           base.SchemaVersion,
+			SpanLogEvents:           base.SpanLogEvents,
+			PayloadEncoding:         base.PayloadEncoding,
+			Humio:                   base.Humio,
+			LogLevels:               base.LogLevels,
+			TraceIngest:             base.TraceIngest,
+		}
+	}
+
+	return router, nil
 }
 
-// Infof logs a message at info priority
-func (j jaegerTohcLog) Infof(msg string, args ...interface{}) {
-	j.inner.Warn("INFO " + fmt.Sprintf(msg, args...))
+func newPlugin(config *PluginConfig, logger hclog.Logger) (*plugin.HumioPlugin, error) {
+	transportConfig := humio.TransportConfig{
+		CAFile:              config.CAFile,
+		CertFile:            config.CertFile,
+		KeyFile:             config.KeyFile,
+		InsecureSkipVerify:  config.InsecureSkipVerify,
+		ProxyURL:            config.ProxyURL,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if transportConfig.MaxIdleConns == 0 {
+		transportConfig.MaxIdleConns = 100
+	}
+	if transportConfig.MaxIdleConnsPerHost == 0 {
+		// All requests go to the same host, so the default of 2 is too low
+		transportConfig.MaxIdleConnsPerHost = 16
+	}
+	if config.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification of humio is disabled")
+	}
+
+	transport, err := humio.NewTransport(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	readToken, err := tokenSource(config.ReadToken, config.ReadTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	writeToken, err := tokenSource(config.WriteToken, config.WriteTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var archiveReadToken, archiveWriteToken humio.TokenSource
+	if config.ArchiveRepo != "" {
+		if archiveReadToken, err = tokenSource(config.ArchiveReadToken, config.ArchiveReadTokenFile); err != nil {
+			return nil, err
+		}
+		if archiveWriteToken, err = tokenSource(config.ArchiveWriteToken, config.ArchiveWriteTokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	logLevels, err := parseLogLevels(config.LogLevels)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &humio.Client{
+		BaseURL: config.Humio,
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   29 * time.Second,
+		},
+		Retry:       &humio.Backoff{},
+		TokenSource: readToken,
+		IngestAPI:   humio.IngestAPI(config.IngestAPI),
+		QueryAPI:    humio.QueryAPI(config.QueryAPI),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if status, err := client.Detect(ctx); err != nil {
+		logger.Warn("Detecting humio version failed, using legacy endpoints", "err", err)
+	} else {
+		logger.Info("Detected humio version", "version", status.Version, "ingestAPI", client.IngestAPI, "queryAPI", client.QueryAPI)
+	}
+
+	return &plugin.HumioPlugin{
+		Logger:                  logger,
+		Repo:                    config.Repo,
+		ReadToken:               readToken,
+		WriteToken:              writeToken,
+		ArchiveRepo:             config.ArchiveRepo,
+		ArchiveReadToken:        archiveReadToken,
+		ArchiveWriteToken:       archiveWriteToken,
+		PrecomputedDependencies: config.PrecomputedDependencies,
+		SchemaVersion:           config.SchemaVersion,
+		SpanLogEvents:           config.SpanLogEvents,
+		PayloadEncoding:         config.PayloadEncoding,
+		Humio:                   client,
+		LogLevels:               logLevels,
+		TraceIngest:             config.SelfTracingIngest,
+	}, nil
 }
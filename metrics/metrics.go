@@ -0,0 +1,115 @@
+// Package metrics contains the prometheus metrics of the plugin.  They
+// are registered with the default registry, and exposed by Handler.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "humio_jaeger"
+
+var (
+	SpansReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spans_received_total",
+		Help:      "Spans received from jaeger by the span writer.",
+	})
+
+	SpansEncoded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spans_encoded_total",
+		Help:      "Spans successfully encoded as humio events.",
+	})
+
+	SpansDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spans_dropped_total",
+		Help:      "Spans dropped before they were buffered for ingest, by reason.",
+	}, []string{"reason"})
+
+	EventsFlushed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_events_flushed_total",
+		Help:      "Events successfully sent to humio.",
+	})
+
+	EventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_events_dropped_total",
+		Help:      "Events dropped because a flush to humio failed.",
+	})
+
+	FlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ingest_flush_duration_seconds",
+		Help:      "Time spent encoding and sending a batch to humio.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	FlushBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ingest_flush_batch_events",
+		Help:      "Number of events per flush to humio.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	BufferedEvents = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingest_buffered_events",
+		Help:      "Events waiting in ingest buffers for the next flush.",
+	})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "humio_requests_total",
+		Help:      "HTTP requests to humio by endpoint and status code (0 for transport errors).",
+	}, []string{"endpoint", "code"})
+
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Latency of span reader and dependency reader methods.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"method"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+)
+
+// CacheResult records a hit or miss for the named cache
+func CacheResult(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// Endpoint returns a low-cardinality label for a humio API path, by
+// removing repository names and query job IDs, for example
+// "/api/v1/repositories/{repo}/queryjobs/{id}".
+func Endpoint(path string) string {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		switch parts[i-1] {
+		case "repositories", "dataspaces":
+			parts[i] = "{repo}"
+		case "queryjobs":
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
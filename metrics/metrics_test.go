@@ -0,0 +1,16 @@
+package metrics
+
+import "testing"
+
+func TestEndpoint(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/v1/ingest/hec":                             "/api/v1/ingest/hec",
+		"/api/v1/repositories/sandbox/query":             "/api/v1/repositories/{repo}/query",
+		"/api/v1/repositories/sandbox/queryjobs":         "/api/v1/repositories/{repo}/queryjobs",
+		"/api/v1/repositories/sandbox/queryjobs/P1-abcd": "/api/v1/repositories/{repo}/queryjobs/{id}",
+	} {
+		if actual := Endpoint(path); actual != expected {
+			t.Errorf("Endpoint(%q) = %q, expected %q", path, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// archiveTraceLookback is how far back the archive reader searches for
+// a trace.  The archive only holds the traces archived from the UI, so
+// searching all of it is cheap.
+const archiveTraceLookback = "10 years"
+
+// ArchiveSpanReader creates a spanstore.Reader for the archive
+// repository.  jaeger only uses GetTrace, when a trace is not found in
+// the main repository.
+func (h *HumioPlugin) ArchiveSpanReader() spanstore.Reader {
+	h.archiveSpanReaderOnce.Do(func() {
+		h.archiveSpanReader = &humioSpanReader{
+			plugin:        h,
+			client:        h.getClient(h.ArchiveReadToken),
+			logger:        h.subsystemLogger("reader").Named("archive"),
+			repo:          h.ArchiveRepo,
+			traceLookback: archiveTraceLookback,
+		}
+	})
+	return h.archiveSpanReader
+}
+
+// ArchiveSpanWriter creates a spanstore.Writer for the archive
+// repository, used by the "Archive Trace" button in the UI
+func (h *HumioPlugin) ArchiveSpanWriter() spanstore.Writer {
+	h.archiveSpanWriterOnce.Do(func() {
+		h.archiveSpanWriter = h.newSpanWriter(h.ArchiveWriteToken, h.subsystemLogger("ingest").Named("archive"))
+	})
+	return h.archiveSpanWriter
+}
+
+// Assert that we implement the upstream interface
+var _ shared.ArchiveStoragePlugin = &HumioPlugin{}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestArchiveSpanReader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v1/repositories/archive/queryjobs") {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer archive-read" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+
+		switch r.Method {
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), archiveTraceLookback) {
+				t.Errorf("expected archive lookback in query %s", body)
+			}
+			w.Write([]byte(`{"id": "1"}`))
+		case "GET":
+			w.Write([]byte(`{"done": true, "events": []}`))
+		}
+	}))
+	defer srv.Close()
+
+	h := &HumioPlugin{
+		Logger:           hclog.NewNullLogger(),
+		Humio:            &humio.Client{BaseURL: srv.URL, Client: &http.Client{}, QueryAPI: humio.QueryJobs},
+		Repo:             "main",
+		ReadToken:        humio.StaticToken("main-read"),
+		ArchiveRepo:      "archive",
+		ArchiveReadToken: humio.StaticToken("archive-read"),
+	}
+
+	_, err := h.ArchiveSpanReader().GetTrace(context.Background(), model.NewTraceID(0, 1))
+	if err != spanstore.ErrTraceNotFound {
+		t.Errorf("expected ErrTraceNotFound, got %v", err)
+	}
+}
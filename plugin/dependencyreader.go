@@ -8,105 +8,186 @@ import (
 	"time"
 
 	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
-	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
+// dependencyRefreshRate limits the requests made when refreshing
+// dependencies in the background, so the many subqueries and polls
+// do not starve interactive queries from the UI.
+var dependencyRefreshRate = rate.Every(500 * time.Millisecond)
+
+// dependencyRefreshInterval is the time between background refreshes
+// of the dependencies
+const dependencyRefreshInterval = 90 * time.Minute
+
 // DependencyReader can load service dependencies from storage.
 func (h *HumioPlugin) DependencyReader() dependencystore.Reader {
-	if h.dependencyReader == nil {
-		h.dependencyReader = &humioDependencyReader{plugin: h, client: h.getClient(h.ReadToken)}
-		go func() {
-			h.dependencyReader.refreshDependencies()
-			time.Sleep(90 * time.Minute)
-		}()
-
-	}
+	h.dependencyReaderOnce.Do(func() {
+		h.dependencyReader = &humioDependencyReader{plugin: h, client: h.getClient(h.ReadToken), logger: h.subsystemLogger("dependencies")}
+		if !h.PrecomputedDependencies {
+			go h.dependencyReader.refreshLoop()
+		}
+	})
 	return h.dependencyReader
 }
 
 type humioDependencyReader struct {
 	plugin *HumioPlugin
 	client *humio.Client
+	logger hclog.Logger
 
 	cache     []model.DependencyLink
 	cacheLock sync.Mutex
 }
 
-func (h *humioDependencyReader) refreshDependencies() error {
+// dependencyQuery finds the parent service of every reference (of
+// any type) by extracting the span IDs from the "refs" attribute,
+// see ReferencesString.
+const dependencyQuery = `refs=* | child := service
+| regex("(?<reftype>CHILD_OF|FOLLOWS_FROM):(?<parent_spanid>[0-9a-f]+)", field=refs, repeat=true)
+| join({spanid=* ` + notLogFilter + ` | parent := service}, key=[spanid], field=[parent_spanid], include=[parent])
+| groupBy([parent, child, reftype])`
+
+// legacyDependencyQuery covers the spans written before the "spanid" and
+// "refs" attributes, by parsing the JSON payload as the first versions
+// of the plugin did.  Only the first reference of those spans is
+// known, and it is counted as CHILD_OF.
+const legacyDependencyQuery = `payload=* NOT spanid=* | parseJson(payload) | child := service | parent_span_id := references[0].span_id
+| join({payload=* NOT spanid=* | parseJson(payload) | parent := service}, key=[span_id], field=[parent_span_id], include=[parent])
+| reftype := "CHILD_OF" | groupBy([parent, child, reftype])`
+
+// Sources used in the returned model.DependencyLink, so CHILD_OF and
+// FOLLOWS_FROM edges between the same services can be told apart
+const (
+	dependencySourceChildOf     = "humio"
+	dependencySourceFollowsFrom = "humio-follows-from"
+)
+
+type dependencyKey struct {
+	parent  string
+	child   string
+	refType model.SpanRefType
+}
+
+// dependencyAggregator sums call counts per parent, child and
+// reference type.  model.DependencyLink has no field for the reference
+// type, so Links returns it in Source, as dependencySourceChildOf or
+// dependencySourceFollowsFrom; jaeger only displays Source.
+type dependencyAggregator map[dependencyKey]uint64
+
+func (d dependencyAggregator) Add(parent, child string, refType model.SpanRefType, count uint64) {
+	if parent == child {
+		return
+	}
+	d[dependencyKey{parent: parent, child: child, refType: refType}] += count
+}
+
+func (d dependencyAggregator) Links() []model.DependencyLink {
+	ret := make([]model.DependencyLink, 0, len(d))
+	for k, count := range d {
+		source := dependencySourceChildOf
+		if k.refType == model.SpanRefType_FOLLOWS_FROM {
+			source = dependencySourceFollowsFrom
+		}
+		ret = append(ret, model.DependencyLink{
+			Parent:    k.parent,
+			Child:     k.child,
+			CallCount: count,
+			Source:    source,
+		})
+	}
+	return ret
+}
+
+// refreshLoop refreshes the dependencies now and then every
+// dependencyRefreshInterval, with a rate limited client
+func (h *humioDependencyReader) refreshLoop() {
+	client := h.plugin.getClient(h.plugin.ReadToken)
+	client.Limiter = rate.NewLimiter(dependencyRefreshRate, 1)
+
+	ticker := time.NewTicker(dependencyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := h.refreshDependencies(client); err != nil {
+			h.logger.Error("Refreshing dependencies failed", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (h *humioDependencyReader) refreshDependencies(client *humio.Client) error {
 	var results []struct {
-		Child  string `json:"child"`
-		Parent string `json:"parent"`
-		Count  string `json:"_count"`
+		Child   string `json:"child"`
+		Parent  string `json:"parent"`
+		RefType string `json:"reftype"`
+		Count   string `json:"_count"`
 	}
 
-	h.plugin.Logger.Warn("refreshDependencies")
+	h.logger.Info("refreshDependencies")
 	defer func() {
-		h.plugin.Logger.Warn("refreshDependencies done")
+		h.logger.Info("refreshDependencies done")
 	}()
 
 	start := time.Now()
 	delta := time.Minute * 15
 
-	type key struct {
-		child  string
-		parent string
-	}
-	hits := make(map[key]model.DependencyLink)
+	hits := make(dependencyAggregator)
 
 	for i := 0; i < int((24*time.Hour)/delta); i++ {
 		partStart := start.Add(time.Duration(i+1) * -delta)
 		partEnd := start.Add(time.Duration(i) * -delta)
-		h.plugin.Logger.Warn("refreshDependencies subquery", "partStart", partStart, "partEnd", partEnd)
-		if err := h.client.QueryDecode(context.Background(), h.plugin.Repo, humio.Q{
-			// QueryString: "parseJson(payload) | groupBy([#service,peer.service,span.kind])",
-			QueryString: `parseJson(payload) | child:=process.service_name | parent_span_id := references[0].span_id
-| join({parseJson(payload) | parent := process.service_name }, key=[span_id], field=[parent_span_id], include=[parent]) | groupBy([parent,child])`,
-			Start: humio.AbsoluteTime(partStart),
-			End:   humio.AbsoluteTime(partEnd),
-		}, &results); err != nil {
-			return err
-		}
-
-		for _, res := range results {
-			if res.Child == res.Parent {
-				continue
+		h.logger.Debug("refreshDependencies subquery", "partStart", partStart, "partEnd", partEnd)
+		for _, query := range []string{dependencyQuery, legacyDependencyQuery} {
+			if err := client.QueryDecode(context.Background(), h.plugin.Repo, humio.Q{
+				QueryString: query,
+				Start:       humio.AbsoluteTime(partStart),
+				End:         humio.AbsoluteTime(partEnd),
+			}, &results); err != nil {
+				return err
 			}
 
-			count, err := strconv.ParseUint(res.Count, 10, 64)
-			if err != nil {
-				return fmt.Errorf("unparsable _count from humio: %q (%+v)", res.Count, res)
-			}
+			for _, res := range results {
+				count, err := strconv.ParseUint(res.Count, 10, 64)
+				if err != nil {
+					return fmt.Errorf("unparsable _count from humio: %q (%+v)", res.Count, res)
+				}
 
-			k := key{res.Child, res.Parent}
-			hit := hits[k]
-			hit.Child = res.Child
-			hit.Parent = res.Parent
-			hit.CallCount += count
-			hit.Source = "humio"
-			hits[k] = hit
-		}
-	}
+				refType, ok := model.SpanRefType_value[res.RefType]
+				if !ok {
+					return fmt.Errorf("unknown reftype from humio: %q (%+v)", res.RefType, res)
+				}
 
-	var ret []model.DependencyLink
-	for _, res := range hits {
-		ret = append(ret, res)
+				hits.Add(res.Parent, res.Child, model.SpanRefType(refType), count)
+			}
+		}
 	}
 
 	h.cacheLock.Lock()
 	defer h.cacheLock.Unlock()
-	h.cache = ret
+	h.cache = hits.Links()
 	return nil
 }
 
 func (h *humioDependencyReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "GetDependencies")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "GetDependencies")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetDependencies")).ObserveDuration()
+
+	if h.plugin.PrecomputedDependencies {
+		links, err := h.readPrecomputedDependencies(ctx, endTs, lookback)
+		return links, grpcError(err)
+	}
 
 	h.cacheLock.Lock()
 	defer h.cacheLock.Unlock()
 
+	// The cache is empty until the first background refresh completes
+	metrics.CacheResult("dependencies", h.cache != nil)
 	return h.cache, nil
 }
 
@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestDependencyAggregator(t *testing.T) {
+	agg := make(dependencyAggregator)
+	agg.Add("frontend", "backend", model.SpanRefType_CHILD_OF, 2)
+	agg.Add("frontend", "backend", model.SpanRefType_CHILD_OF, 3)
+	agg.Add("frontend", "backend", model.SpanRefType_FOLLOWS_FROM, 1)
+	agg.Add("frontend", "frontend", model.SpanRefType_CHILD_OF, 10)
+
+	links := agg.Links()
+	sort.Slice(links, func(i, j int) bool { return links[i].Source < links[j].Source })
+
+	want := []model.DependencyLink{
+		{Parent: "frontend", Child: "backend", CallCount: 5, Source: dependencySourceChildOf},
+		{Parent: "frontend", Child: "backend", CallCount: 1, Source: dependencySourceFollowsFrom},
+	}
+
+	if len(links) != len(want) {
+		t.Fatalf("got %d links, want %d: %+v", len(links), len(want), links)
+	}
+
+	for i := range want {
+		if !reflect.DeepEqual(links[i], want[i]) {
+			t.Errorf("link %d = %+v, want %+v", i, links[i], want[i])
+		}
+	}
+}
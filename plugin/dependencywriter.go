@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// precomputedDependencyQuery sums the events written by
+// WriteDependencies
+const precomputedDependencyQuery = `kind=dependencies | groupBy([parent, child, source], function=sum(call_count, as=_count))`
+
+// spanRelationQuery loads what we need to know about each span to
+// compute dependencies in Go
+const spanRelationQuery = `spanid=* ` + notLogFilter + ` | select([traceid, spanid, service, refs])`
+
+// ComputeDependencies loads the service, span ID and references of
+// all spans between from and to, and computes the service
+// dependencies without relying on a humio join.
+func (h *HumioPlugin) ComputeDependencies(ctx context.Context, from, to time.Time) ([]model.DependencyLink, error) {
+	client := h.getClient(h.ReadToken)
+	logger := h.subsystemLogger("dependencies")
+
+	type spanKey struct {
+		traceID string
+		spanID  model.SpanID
+	}
+
+	type childRef struct {
+		child  string
+		parent spanKey
+		ref    model.SpanRefType
+	}
+
+	services := make(map[spanKey]string)
+	var refs []childRef
+
+	delta := time.Minute * 15
+	for partStart := from; partStart.Before(to); partStart = partStart.Add(delta) {
+		partEnd := partStart.Add(delta)
+		if partEnd.After(to) {
+			partEnd = to
+		}
+
+		logger.Debug("ComputeDependencies subquery", "partStart", partStart, "partEnd", partEnd)
+
+		var results []struct {
+			TraceID string `json:"traceid"`
+			SpanID  string `json:"spanid"`
+			Service string `json:"service"`
+			Refs    string `json:"refs"`
+		}
+		if err := client.QueryDecode(ctx, h.Repo, humio.Q{
+			QueryString: spanRelationQuery,
+			Start:       humio.AbsoluteTime(partStart),
+			End:         humio.AbsoluteTime(partEnd),
+		}, &results); err != nil {
+			return nil, err
+		}
+
+		for _, res := range results {
+			spanID, err := model.SpanIDFromString(res.SpanID)
+			if err != nil {
+				return nil, fmt.Errorf("unparsable spanid from humio: %q (%+v)", res.SpanID, res)
+			}
+			services[spanKey{res.TraceID, spanID}] = res.Service
+
+			spanRefs, err := ParseReferencesString(res.Refs)
+			if err != nil {
+				return nil, fmt.Errorf("unparsable refs from humio: %w (%+v)", err, res)
+			}
+
+			for _, ref := range spanRefs {
+				refs = append(refs, childRef{
+					child:  res.Service,
+					parent: spanKey{res.TraceID, ref.SpanID},
+					ref:    ref.RefType,
+				})
+			}
+		}
+	}
+
+	hits := make(dependencyAggregator)
+	for _, ref := range refs {
+		// The parent may be outside the time range, or not sampled
+		if parent, found := services[ref.parent]; found {
+			hits.Add(parent, ref.child, ref.ref, 1)
+		}
+	}
+
+	return hits.Links(), nil
+}
+
+// WriteDependencies stores the dependency links as one humio event
+// per link, so they can be read back by a dependency reader with
+// PrecomputedDependencies set.
+func (h *HumioPlugin) WriteDependencies(ctx context.Context, ts time.Time, links []model.DependencyLink) error {
+	ingest := &humio.BatchIngester{Client: h.getClient(h.WriteToken)}
+	for _, link := range links {
+		ingest.AddEvent(kindDependencies.tags(), kindDependencies.event(ts, map[string]interface{}{
+			"parent":     link.Parent,
+			"child":      link.Child,
+			"call_count": strconv.FormatUint(link.CallCount, 10),
+			"source":     link.Source,
+		}))
+	}
+
+	return ingest.Flush(ctx)
+}
+
+// readPrecomputedDependencies sums the links stored by
+// WriteDependencies in the given time range
+func (h *humioDependencyReader) readPrecomputedDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	var results []struct {
+		Parent string `json:"parent"`
+		Child  string `json:"child"`
+		Source string `json:"source"`
+		Count  string `json:"_count"`
+	}
+
+	if err := h.client.QueryDecode(ctx, h.plugin.Repo, humio.Q{
+		QueryString: precomputedDependencyQuery,
+		Start:       humio.AbsoluteTime(endTs.Add(-lookback)),
+		End:         humio.AbsoluteTime(endTs),
+	}, &results); err != nil {
+		return nil, err
+	}
+
+	ret := make([]model.DependencyLink, 0, len(results))
+	for _, res := range results {
+		// sum() may return a float, such as "3.0"
+		count, err := strconv.ParseFloat(res.Count, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unparsable _count from humio: %q (%+v)", res.Count, res)
+		}
+
+		ret = append(ret, model.DependencyLink{
+			Parent:    res.Parent,
+			Child:     res.Child,
+			CallCount: uint64(count),
+			Source:    res.Source,
+		})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcError maps errors from the humio client to gRPC status codes,
+// so jaeger can tell a bad query from an overloaded or misconfigured
+// humio.  spanstore.ErrTraceNotFound is passed through unchanged, as
+// jaeger compares it by identity.
+func grpcError(err error) error {
+	if err == nil || err == spanstore.ErrTraceNotFound {
+		return err
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var apiErr *humio.APIError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case humio.IsAuth(err):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case humio.IsQuerySyntax(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &apiErr) && apiErr.StatusCode == 429:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case humio.IsRetryable(err):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
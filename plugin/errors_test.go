@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCError(t *testing.T) {
+	if err := grpcError(spanstore.ErrTraceNotFound); err != spanstore.ErrTraceNotFound {
+		t.Errorf("ErrTraceNotFound must be passed through, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{&humio.APIError{StatusCode: http.StatusUnauthorized}, codes.PermissionDenied},
+		{&humio.APIError{StatusCode: http.StatusBadRequest, Endpoint: "/api/v1/repositories/sandbox/query"}, codes.InvalidArgument},
+		{&humio.APIError{StatusCode: http.StatusTooManyRequests}, codes.ResourceExhausted},
+		{&humio.APIError{StatusCode: http.StatusServiceUnavailable}, codes.Unavailable},
+		{&humio.APIError{StatusCode: http.StatusInternalServerError}, codes.Internal},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{fmt.Errorf("query job returned no results before the deadline: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{errors.New("unparsable payload from humio: unexpected end of JSON input"), codes.Internal},
+		{checkSchema("3"), codes.Internal},
+	} {
+		if got := status.Code(grpcError(tc.err)); got != tc.code {
+			t.Errorf("grpcError(%v) = %v, want %v", tc.err, got, tc.code)
+		}
+	}
+}
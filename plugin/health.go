@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/health"
+	"github.com/chlunde/humio-jaeger-storage/humio"
+)
+
+// HealthChecker returns a checker verifying that humio is up, that the
+// read token can search the repository and that the write token can
+// ingest into it.  The clients are not traced, as the periodic checks
+// would drown out the interesting traces.
+func (h *HumioPlugin) HealthChecker(interval time.Duration) *health.Checker {
+	read, write := h.tokenChecks()
+	return &health.Checker{
+		Checks: map[string]health.Check{
+			"status": h.statusCheck(),
+			"read":   read,
+			"write":  write,
+		},
+		Interval: interval,
+		Logger:   h.subsystemLogger("health"),
+	}
+}
+
+// statusCheck verifies that humio is up
+func (h *HumioPlugin) statusCheck() health.Check {
+	status := h.getClient(h.ReadToken)
+	status.DisableTracing = true
+
+	return func(ctx context.Context) error {
+		s, err := status.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if s.Status != "OK" && s.Status != "WARN" {
+			return fmt.Errorf("humio status is %q", s.Status)
+		}
+		return nil
+	}
+}
+
+// tokenChecks verify that the read token can search the repository
+// and that the write token can ingest into it
+func (h *HumioPlugin) tokenChecks() (readCheck, writeCheck health.Check) {
+	read := h.getClient(h.ReadToken)
+	read.DisableTracing = true
+
+	write := h.getClient(h.WriteToken)
+	write.DisableTracing = true
+
+	readCheck = func(ctx context.Context) error {
+		var results []json.RawMessage
+		return read.QueryDecode(ctx, h.Repo, humio.Q{
+			QueryString: "head(1)",
+			Start:       humio.RelativeTime("1 minute"),
+		}, &results)
+	}
+
+	writeCheck = write.CheckIngestToken
+
+	return readCheck, writeCheck
+}
@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthCheckerWritesNothing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/status":
+			io.WriteString(w, `{"status":"OK","version":"1.60.0"}`)
+		case "/api/v1/repositories/sandbox/query":
+			io.WriteString(w, `[]`)
+		case "/api/v1/ingest/humio-structured":
+			if r.Header.Get("Authorization") != "Bearer write" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != "[]" {
+				t.Errorf("expected an empty batch, got %s", body)
+			}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	h := &HumioPlugin{
+		Logger:     hclog.NewNullLogger(),
+		Humio:      &humio.Client{BaseURL: srv.URL, Client: &http.Client{}, QueryAPI: humio.QuerySync},
+		Repo:       "sandbox",
+		ReadToken:  humio.StaticToken("read"),
+		WriteToken: humio.StaticToken("write"),
+	}
+
+	flushed := testutil.ToFloat64(metrics.EventsFlushed)
+	buffered := testutil.ToFloat64(metrics.BufferedEvents)
+
+	checker := h.HealthChecker(time.Second)
+	checker.RunOnce(context.Background())
+	if ready, results := checker.Ready(); !ready {
+		t.Fatalf("expected the checks to pass, got %+v", results)
+	}
+
+	if got := testutil.ToFloat64(metrics.EventsFlushed); got != flushed {
+		t.Errorf("events flushed changed from %v to %v", flushed, got)
+	}
+	if got := testutil.ToFloat64(metrics.BufferedEvents); got != buffered {
+		t.Errorf("buffered events changed from %v to %v", buffered, got)
+	}
+
+	h.WriteToken = humio.StaticToken("wrong")
+	checker = h.HealthChecker(time.Second)
+	checker.RunOnce(context.Background())
+	if ready, results := checker.Ready(); ready || results["write"].Error == "" {
+		t.Errorf("expected the write check to fail, got %+v", results)
+	}
+}
@@ -0,0 +1,297 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/gogo/protobuf/types"
+	"github.com/hashicorp/go-hclog"
+	jaegermetrics "github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for the optional query parameters, matching the defaults
+// of the jaeger UI
+const (
+	defaultMetricsLookback = time.Hour
+	defaultMetricsStep     = time.Minute
+
+	// minMetricsStep is the smallest bucket humio accepts in a
+	// relative time such as "60s"
+	minMetricsStep = time.Second
+
+	// maxMetricsSeries is the highest limit of series accepted by
+	// bucket()
+	maxMetricsSeries = 500
+)
+
+// MetricsReader creates a metricsstore.Reader for jaeger's Service
+// Performance Monitoring, which computes latencies, call rates and
+// error rates from the span events with humio aggregations.
+//
+// jaeger 1.39 has no metrics reader in the gRPC plugin protocol, so
+// the reader is only served by the standalone server, with jaeger's
+// MetricsQueryService API, see MetricsQueryServer.
+func (h *HumioPlugin) MetricsReader() metricsstore.Reader {
+	return &humioMetricsReader{
+		plugin: h,
+		client: h.getClient(h.ReadToken),
+		logger: h.subsystemLogger("reader"),
+	}
+}
+
+type humioMetricsReader struct {
+	plugin *HumioPlugin
+	client *humio.Client
+	logger hclog.Logger
+}
+
+// metricsQuery is a bucket() aggregation, the long form of timeChart()
+// with one row per series and bucket, over the spans matching params
+type metricsQuery struct {
+	name        string
+	description string
+
+	// eval is inserted between the span filter and the aggregation
+	eval string
+	// function is the bucket() function
+	function string
+	// value computes the data point of a row
+	value func(row map[string]string, step time.Duration) (float64, error)
+}
+
+// spanKindTagValue maps the span kinds of the metrics API, such as
+// SPAN_KIND_SERVER, to the values of the "span.kind" tag
+func spanKindTagValue(kind string) string {
+	return strings.ToLower(strings.TrimPrefix(kind, "SPAN_KIND_"))
+}
+
+// quoteList formats values as a humio array of strings
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + humio.EscapeFieldFilter(v) + `"`
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// groupFields are the fields of the series, which are also the labels
+// of the metrics
+func groupFields(params *metricsstore.BaseQueryParameters) []string {
+	if params.GroupByOperation {
+		return []string{"service", "operation"}
+	}
+	return []string{"service"}
+}
+
+// metricsQueryString builds the humio query computing q for params
+func metricsQueryString(q metricsQuery, params *metricsstore.BaseQueryParameters, step time.Duration) string {
+	query := &bytes.Buffer{}
+	query.WriteString("spanid=* " + notLogFilter + " ")
+	fmt.Fprintf(query, "| in(service, values=%s) ", quoteList(params.ServiceNames))
+
+	if len(params.SpanKinds) > 0 {
+		// Match the tag of any schema version, see tagFilter
+		kinds := make([]string, len(params.SpanKinds))
+		for i, kind := range params.SpanKinds {
+			v := humio.EscapeFieldFilter(spanKindTagValue(kind))
+			kinds[i] = fmt.Sprintf(`span.kind="%s" OR %sspan.kind="%s"`, v, tagPrefix, v)
+		}
+		fmt.Fprintf(query, "| (%s) ", strings.Join(kinds, " OR "))
+	}
+
+	if q.eval != "" {
+		fmt.Fprintf(query, "| %s ", q.eval)
+	}
+
+	fmt.Fprintf(query, "| bucket(span=%ds, field=[%s], limit=%d, function=%s)",
+		int64(step/time.Second), strings.Join(groupFields(params), ", "), maxMetricsSeries, q.function)
+	return query.String()
+}
+
+func (h *humioMetricsReader) query(ctx context.Context, q metricsQuery, params *metricsstore.BaseQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	ctx, span := tracer.Start(ctx, q.name)
+	defer span.End()
+
+	end := time.Now()
+	if params.EndTime != nil {
+		end = *params.EndTime
+	}
+
+	lookback := defaultMetricsLookback
+	if params.Lookback != nil {
+		lookback = *params.Lookback
+	}
+
+	step := defaultMetricsStep
+	if params.Step != nil {
+		step = *params.Step
+	}
+	if step < minMetricsStep {
+		step = minMetricsStep
+	}
+
+	queryString := metricsQueryString(q, params, step)
+	h.logger.Debug("Metrics query", "query", queryString)
+
+	var results []map[string]string
+	if err := h.client.QueryDecode(ctx, h.plugin.Repo, humio.Q{
+		QueryString: queryString,
+		Start:       humio.AbsoluteTime(end.Add(-lookback)),
+		End:         humio.AbsoluteTime(end),
+	}, &results); err != nil {
+		return nil, err
+	}
+
+	name, description := q.name, q.description
+	if params.GroupByOperation {
+		name = strings.Replace(name, "service", "service_operation", 1)
+		description += " & operation"
+	}
+
+	family, err := toMetricFamily(results, groupFields(params), step, q.value)
+	if err != nil {
+		return nil, err
+	}
+	family.Name = name
+	family.Help = description
+	return family, nil
+}
+
+// toMetricFamily converts the rows returned by a bucket() query to one
+// metric per series, labelled like the metrics of jaeger's prometheus
+// reader
+func toMetricFamily(rows []map[string]string, fields []string, step time.Duration, value func(map[string]string, time.Duration) (float64, error)) (*jaegermetrics.MetricFamily, error) {
+	labelNames := map[string]string{"service": "service_name", "operation": "operation"}
+
+	series := make(map[string]*jaegermetrics.Metric)
+	var keys []string
+	for _, row := range rows {
+		ms, err := strconv.ParseInt(row["_bucket"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unparsable _bucket from humio: %q (%+v)", row["_bucket"], row)
+		}
+
+		v, err := value(row, step)
+		if err != nil {
+			return nil, fmt.Errorf("%w (%+v)", err, row)
+		}
+
+		var key strings.Builder
+		for _, field := range fields {
+			key.WriteString(row[field])
+			key.WriteByte(0)
+		}
+
+		metric, found := series[key.String()]
+		if !found {
+			metric = &jaegermetrics.Metric{}
+			for _, field := range fields {
+				metric.Labels = append(metric.Labels, &jaegermetrics.Label{Name: labelNames[field], Value: row[field]})
+			}
+			series[key.String()] = metric
+			keys = append(keys, key.String())
+		}
+
+		metric.MetricPoints = append(metric.MetricPoints, &jaegermetrics.MetricPoint{
+			Timestamp: &types.Timestamp{Seconds: ms / 1000, Nanos: int32(ms%1000) * 1_000_000},
+			Value: &jaegermetrics.MetricPoint_GaugeValue{
+				GaugeValue: &jaegermetrics.GaugeValue{
+					Value: &jaegermetrics.GaugeValue_DoubleValue{DoubleValue: v},
+				},
+			},
+		})
+	}
+
+	sort.Strings(keys)
+	family := &jaegermetrics.MetricFamily{Type: jaegermetrics.MetricType_GAUGE}
+	for _, key := range keys {
+		metric := series[key]
+		sort.Slice(metric.MetricPoints, func(i, j int) bool {
+			a, b := metric.MetricPoints[i].Timestamp, metric.MetricPoints[j].Timestamp
+			return a.Seconds < b.Seconds || a.Seconds == b.Seconds && a.Nanos < b.Nanos
+		})
+		family.Metrics = append(family.Metrics, metric)
+	}
+	return family, nil
+}
+
+// parseFloatField parses a number from a row, where a missing field
+// (such as the aggregate of an empty bucket) is zero
+func parseFloatField(row map[string]string, field string) (float64, error) {
+	s, found := row[field]
+	if !found || s == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unparsable %s from humio: %q", field, s)
+	}
+	return v, nil
+}
+
+func (h *humioMetricsReader) GetLatencies(ctx context.Context, params *metricsstore.LatenciesQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetLatencies")).ObserveDuration()
+
+	// percentile() names the output field after the percentile, such
+	// as _99 or _99.9
+	percentile := strconv.FormatFloat(params.Quantile*100, 'f', -1, 64)
+	return h.query(ctx, metricsQuery{
+		name:        "service_latencies",
+		description: fmt.Sprintf("%.2fth quantile latency, grouped by service", params.Quantile),
+		function:    fmt.Sprintf("percentile(field=duration_ms, percentiles=[%s])", percentile),
+		value: func(row map[string]string, _ time.Duration) (float64, error) {
+			return parseFloatField(row, "_"+percentile)
+		},
+	}, &params.BaseQueryParameters)
+}
+
+func (h *humioMetricsReader) GetCallRates(ctx context.Context, params *metricsstore.CallRateQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetCallRates")).ObserveDuration()
+
+	return h.query(ctx, metricsQuery{
+		name:        "service_call_rate",
+		description: "calls/sec, grouped by service",
+		function:    "count(as=calls)",
+		value: func(row map[string]string, step time.Duration) (float64, error) {
+			calls, err := parseFloatField(row, "calls")
+			return calls / step.Seconds(), err
+		},
+	}, &params.BaseQueryParameters)
+}
+
+func (h *humioMetricsReader) GetErrorRates(ctx context.Context, params *metricsstore.ErrorRateQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetErrorRates")).ObserveDuration()
+
+	return h.query(ctx, metricsQuery{
+		name:        "service_error_rate",
+		description: "error rate, computed as a fraction of errors/sec over calls/sec, grouped by service",
+		eval:        "case { error=true | is_error := 1 ; " + tagPrefix + "error=true | is_error := 1 ; * | is_error := 0 }",
+		function:    "[count(as=calls), sum(is_error, as=errors)]",
+		value: func(row map[string]string, _ time.Duration) (float64, error) {
+			calls, err := parseFloatField(row, "calls")
+			if err != nil || calls == 0 {
+				return 0, err
+			}
+
+			errors, err := parseFloatField(row, "errors")
+			return errors / calls, err
+		},
+	}, &params.BaseQueryParameters)
+}
+
+func (h *humioMetricsReader) GetMinStepDuration(ctx context.Context, params *metricsstore.MinStepDurationQueryParameters) (time.Duration, error) {
+	return minMetricsStep, nil
+}
+
+// Assert that we implement the upstream interface
+var _ metricsstore.Reader = &humioMetricsReader{}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+)
+
+func TestMetricsQueryString(t *testing.T) {
+	params := &metricsstore.BaseQueryParameters{
+		ServiceNames:     []string{"frontend", `say "hi"`},
+		GroupByOperation: true,
+		SpanKinds:        []string{"SPAN_KIND_SERVER"},
+	}
+
+	got := metricsQueryString(metricsQuery{function: "count(as=calls)"}, params, time.Minute)
+	want := `spanid=* NOT kind=log | in(service, values=["frontend", "say \"hi\""]) | (span.kind="server" OR tag.span.kind="server") | bucket(span=60s, field=[service, operation], limit=500, function=count(as=calls))`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestToMetricFamily(t *testing.T) {
+	rows := []map[string]string{
+		{"_bucket": "1665000060000", "service": "frontend", "calls": "120"},
+		{"_bucket": "1665000000000", "service": "frontend", "calls": "60"},
+		{"_bucket": "1665000000000", "service": "backend"},
+	}
+
+	family, err := toMetricFamily(rows, []string{"service"}, time.Minute, func(row map[string]string, step time.Duration) (float64, error) {
+		calls, err := parseFloatField(row, "calls")
+		return calls / step.Seconds(), err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(family.Metrics) != 2 {
+		t.Fatalf("expected 2 series, got %+v", family.Metrics)
+	}
+
+	backend, frontend := family.Metrics[0], family.Metrics[1]
+	if backend.Labels[0].Name != "service_name" || backend.Labels[0].Value != "backend" {
+		t.Errorf("unexpected labels %+v", backend.Labels)
+	}
+
+	if len(frontend.MetricPoints) != 2 || frontend.MetricPoints[0].Timestamp.Seconds != 1665000000 {
+		t.Fatalf("expected points sorted by time, got %+v", frontend.MetricPoints)
+	}
+
+	if v := frontend.MetricPoints[1].GetGaugeValue().GetDoubleValue(); v != 2 {
+		t.Errorf("expected 2 calls/sec, got %v", v)
+	}
+
+	if _, err := toMetricFamily([]map[string]string{{"_bucket": "now"}}, nil, time.Minute, nil); err == nil {
+		t.Error("expected error for unparsable _bucket")
+	}
+}
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"context"
+
+	jaegermetrics "github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsQueryServer serves jaeger's MetricsQueryService gRPC API, the
+// API of jaeger-query for the Monitor tab, from a metricsstore.Reader
+// such as HumioPlugin.MetricsReader.  Unset parameters of the requests
+// take the defaults of the reader.
+type MetricsQueryServer struct {
+	Reader metricsstore.Reader
+}
+
+// baseQueryParameters validates and converts the common parameters of
+// the requests
+func baseQueryParameters(r *jaegermetrics.MetricsQueryBaseRequest) (metricsstore.BaseQueryParameters, error) {
+	if r == nil || len(r.ServiceNames) == 0 {
+		return metricsstore.BaseQueryParameters{}, status.Error(codes.InvalidArgument, "please provide at least one service name")
+	}
+
+	params := metricsstore.BaseQueryParameters{
+		ServiceNames:     r.ServiceNames,
+		GroupByOperation: r.GroupByOperation,
+		EndTime:          r.EndTime,
+		Lookback:         r.Lookback,
+		Step:             r.Step,
+		RatePer:          r.RatePer,
+	}
+	for _, kind := range r.SpanKinds {
+		params.SpanKinds = append(params.SpanKinds, kind.String())
+	}
+	return params, nil
+}
+
+func (s *MetricsQueryServer) GetMinStepDuration(ctx context.Context, r *jaegermetrics.GetMinStepDurationRequest) (*jaegermetrics.GetMinStepDurationResponse, error) {
+	step, err := s.Reader.GetMinStepDuration(ctx, &metricsstore.MinStepDurationQueryParameters{})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &jaegermetrics.GetMinStepDurationResponse{MinStep: step}, nil
+}
+
+func (s *MetricsQueryServer) GetLatencies(ctx context.Context, r *jaegermetrics.GetLatenciesRequest) (*jaegermetrics.GetMetricsResponse, error) {
+	params, err := baseQueryParameters(r.GetBaseRequest())
+	if err != nil {
+		return nil, err
+	}
+	if r.Quantile <= 0 || r.Quantile > 1 {
+		return nil, status.Error(codes.InvalidArgument, "please provide a quantile between (0, 1]")
+	}
+
+	family, err := s.Reader.GetLatencies(ctx, &metricsstore.LatenciesQueryParameters{BaseQueryParameters: params, Quantile: r.Quantile})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &jaegermetrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+func (s *MetricsQueryServer) GetCallRates(ctx context.Context, r *jaegermetrics.GetCallRatesRequest) (*jaegermetrics.GetMetricsResponse, error) {
+	params, err := baseQueryParameters(r.GetBaseRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := s.Reader.GetCallRates(ctx, &metricsstore.CallRateQueryParameters{BaseQueryParameters: params})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &jaegermetrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+func (s *MetricsQueryServer) GetErrorRates(ctx context.Context, r *jaegermetrics.GetErrorRatesRequest) (*jaegermetrics.GetMetricsResponse, error) {
+	params, err := baseQueryParameters(r.GetBaseRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := s.Reader.GetErrorRates(ctx, &metricsstore.ErrorRateQueryParameters{BaseQueryParameters: params})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &jaegermetrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+// Assert that we implement the upstream interface
+var _ jaegermetrics.MetricsQueryServiceServer = &MetricsQueryServer{}
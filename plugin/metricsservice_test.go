@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	jaegermetrics "github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingMetricsReader records the parameters of GetLatencies
+type recordingMetricsReader struct {
+	metricsstore.Reader
+	latencies *metricsstore.LatenciesQueryParameters
+}
+
+func (r *recordingMetricsReader) GetLatencies(ctx context.Context, params *metricsstore.LatenciesQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	r.latencies = params
+	return &jaegermetrics.MetricFamily{Name: "service_latencies"}, nil
+}
+
+func TestMetricsQueryServerGetLatencies(t *testing.T) {
+	reader := &recordingMetricsReader{}
+	s := &MetricsQueryServer{Reader: reader}
+
+	step := 30 * time.Second
+	resp, err := s.GetLatencies(context.Background(), &jaegermetrics.GetLatenciesRequest{
+		BaseRequest: &jaegermetrics.MetricsQueryBaseRequest{
+			ServiceNames: []string{"frontend"},
+			Step:         &step,
+			SpanKinds:    []jaegermetrics.SpanKind{jaegermetrics.SpanKind_SPAN_KIND_SERVER},
+		},
+		Quantile: 0.95,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Metrics.Name != "service_latencies" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	params := reader.latencies
+	if params.Quantile != 0.95 || *params.Step != step || params.Lookback != nil || len(params.SpanKinds) != 1 || params.SpanKinds[0] != "SPAN_KIND_SERVER" {
+		t.Errorf("unexpected parameters %+v", params)
+	}
+}
+
+func TestMetricsQueryServerInvalidArgument(t *testing.T) {
+	s := &MetricsQueryServer{Reader: &recordingMetricsReader{}}
+
+	_, err := s.GetLatencies(context.Background(), &jaegermetrics.GetLatenciesRequest{Quantile: 0.95})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without services, got %v", err)
+	}
+
+	_, err = s.GetLatencies(context.Background(), &jaegermetrics.GetLatenciesRequest{
+		BaseRequest: &jaegermetrics.MetricsQueryBaseRequest{ServiceNames: []string{"frontend"}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without quantile, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// Encodings of the span in the "payload" attribute.  JSON payloads are
+// stored as is, while the others are prefixed by the encoding and a
+// colon, such as "proto:CgQ...", so each event records its own
+// encoding and the readers decode any mix of them.
+const (
+	PayloadJSON      = "json"
+	PayloadProto     = "proto"      // base64 of the gogo protobuf encoding
+	PayloadProtoGzip = "proto-gzip" // base64 of the gzipped protobuf encoding
+)
+
+// PayloadEncodings lists the valid values of HumioPlugin.PayloadEncoding
+var PayloadEncodings = []string{PayloadJSON, PayloadProto, PayloadProtoGzip}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	gzipReaders sync.Pool
+)
+
+// encodePayload encodes the span for the "payload" attribute
+func encodePayload(span *model.Span, encoding string) (string, error) {
+	switch encoding {
+	case "", PayloadJSON:
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(span); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case PayloadProto, PayloadProtoGzip:
+	default:
+		return "", fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+
+	data, err := span.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	if encoding == PayloadProtoGzip {
+		buf := &bytes.Buffer{}
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(buf)
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+
+	return encoding + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodePayload decodes a "payload" attribute written with any
+// encoding
+func decodePayload(payload string) (*model.Span, error) {
+	payload = strings.TrimSpace(payload)
+
+	var span model.Span
+	if strings.HasPrefix(payload, "{") {
+		if err := json.Unmarshal([]byte(payload), &span); err != nil {
+			return nil, err
+		}
+		return &span, nil
+	}
+
+	encoding, encoded, found := strings.Cut(payload, ":")
+	if !found || (encoding != PayloadProto && encoding != PayloadProtoGzip) {
+		return nil, fmt.Errorf("unknown payload encoding in %.20q", payload)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s payload: %w", encoding, err)
+	}
+
+	if encoding == PayloadProtoGzip {
+		if data, err = gunzip(data); err != nil {
+			return nil, fmt.Errorf("decoding %s payload: %w", encoding, err)
+		}
+	}
+
+	if err := span.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("decoding %s payload: %w", encoding, err)
+	}
+	return &span, nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, ok := gzipReaders.Get().(*gzip.Reader)
+	if ok {
+		if err := r.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	defer gzipReaders.Put(r)
+
+	return io.ReadAll(r)
+}
+
+// decodePayloads decodes the newline separated payloads collected from
+// the events of a trace
+func decodePayloads(payloads string) ([]*model.Span, error) {
+	var spans []*model.Span
+	for _, payload := range strings.Split(payloads, "\n") {
+		if payload == "" {
+			continue
+		}
+
+		span, err := decodePayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func testPayloadSpan() *model.Span {
+	traceID := model.NewTraceID(1, 2)
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(3),
+		OperationName: "GET /api/orders",
+		StartTime:     time.Unix(1665000000, 123000).UTC(),
+		Duration:      12 * time.Millisecond,
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.String("http.url", "https://shop.example.com/api/orders?page=2"),
+			model.Int64("http.status_code", 200),
+			model.Float64("sampler.param", 0.001),
+			model.Bool("error", false),
+		},
+		Logs: []model.Log{{
+			Timestamp: time.Unix(1665000000, 5000000).UTC(),
+			Fields:    []model.KeyValue{model.String("event", "cache miss"), model.String("key", "orders:2")},
+		}},
+		Process:    model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "frontend-7d9c8b-x2x4q"), model.String("client-uuid", "4b8c1f2e3a5d6e7f")}),
+		References: []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(4))},
+	}
+}
+
+func TestPayloadEncodings(t *testing.T) {
+	span := testPayloadSpan()
+	for _, encoding := range PayloadEncodings {
+		payload, err := encodePayload(span, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		if encoding != PayloadJSON && !strings.HasPrefix(payload, encoding+":") {
+			t.Errorf("%s: missing encoding marker in %.20q", encoding, payload)
+		}
+
+		decoded, err := decodePayload(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		// Compare the text format, as the decoders differ in nil and
+		// empty slices
+		if span.String() != decoded.String() {
+			t.Errorf("%s: got %s, want %s", encoding, decoded, span)
+		}
+	}
+
+	if _, err := encodePayload(span, "xml"); err == nil {
+		t.Error("expected error for unknown encoding")
+	}
+
+	for _, bad := range []string{"xml:PHNwYW4+", "proto:***", "proto-gzip:AAAA"} {
+		if _, err := decodePayload(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestDecodePayloadsMixed(t *testing.T) {
+	var payloads []string
+	for _, encoding := range PayloadEncodings {
+		payload, err := encodePayload(testPayloadSpan(), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	// collect() separates the values by newlines
+	spans, err := decodePayloads(strings.Join(payloads, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spans) != len(PayloadEncodings) {
+		t.Errorf("expected %d spans, got %d", len(PayloadEncodings), len(spans))
+	}
+}
+
+// BenchmarkEncodePayload reports the size of the payload of a typical
+// span in each encoding, in addition to the time to encode it
+func BenchmarkEncodePayload(b *testing.B) {
+	span := testPayloadSpan()
+	for _, encoding := range PayloadEncodings {
+		b.Run(encoding, func(b *testing.B) {
+			var payload string
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if payload, err = encodePayload(span, encoding); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(payload)), "bytes/span")
+		})
+	}
+}
+
+func BenchmarkDecodePayload(b *testing.B) {
+	for _, encoding := range PayloadEncodings {
+		payload, err := encodePayload(testPayloadSpan(), encoding)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodePayload(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
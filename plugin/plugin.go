@@ -1,26 +1,94 @@
 package plugin
 
 import (
+	"sync"
+
 	"github.com/chlunde/humio-jaeger-storage/humio"
 	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
 )
 
+// tracer creates the spans of the plugin itself, see humio.Client for
+// the spans of requests to humio
+var tracer = otel.Tracer("github.com/chlunde/humio-jaeger-storage/plugin")
+
 type HumioPlugin struct {
 	Logger     hclog.Logger
 	Humio      *humio.Client
 	Repo       string
-	ReadToken  string
-	WriteToken string
+	ReadToken  humio.TokenSource
+	WriteToken humio.TokenSource
+
+	// LogLevels overrides the level of Logger for the subsystems
+	// listed in Subsystems. Logger must be created with
+	// IndependentLevels for this to work.
+	LogLevels map[string]hclog.Level
+
+	// PrecomputedDependencies makes the dependency reader read links
+	// stored by WriteDependencies (see the "dependencies" command)
+	// instead of computing them from the spans.
+	PrecomputedDependencies bool
+
+	// ArchiveRepo, ArchiveReadToken and ArchiveWriteToken configure
+	// a separate repository for archived traces, usually with a long
+	// retention, see ArchiveSpanReader.
+	ArchiveRepo       string
+	ArchiveReadToken  humio.TokenSource
+	ArchiveWriteToken humio.TokenSource
+
+	// SchemaVersion is the version of the span events written,
+	// SchemaV1 if zero.  Readers handle all versions.
+	SchemaVersion int
+
+	// SpanLogEvents writes each span log as a separate event, so logs
+	// can be searched in humio, see LogEvents
+	SpanLogEvents bool
+
+	// PayloadEncoding of the spans in the "payload" attribute, one of
+	// PayloadEncodings, PayloadJSON if empty.  Readers decode all
+	// encodings.
+	PayloadEncoding string
+
+	// TraceIngest enables self-tracing of the span writer.  It is
+	// off by default, as tracing the ingest of spans into the same
+	// jaeger creates new spans to ingest, forever.
+	TraceIngest bool
+
+	// The readers and writers are created on first use, once, as the
+	// standalone server calls the accessors concurrently
+	spanReader            *humioSpanReader
+	spanReaderOnce        sync.Once
+	spanWriter            *humioSpanWriter
+	spanWriterOnce        sync.Once
+	dependencyReader      *humioDependencyReader
+	dependencyReaderOnce  sync.Once
+	archiveSpanReader     *humioSpanReader
+	archiveSpanReaderOnce sync.Once
+	archiveSpanWriter     *humioSpanWriter
+	archiveSpanWriterOnce sync.Once
+}
+
+// Subsystems are the names of the sub-loggers of HumioPlugin.Logger
+var Subsystems = []string{"reader", "ingest", "dependencies", "client", "health"}
 
-	spanReader       *humioSpanReader
-	spanWriter       *humioSpanWriter
-	dependencyReader *humioDependencyReader
+// subsystemLogger returns a named sub-logger with the level from
+// LogLevels, if any
+func (h *HumioPlugin) subsystemLogger(name string) hclog.Logger {
+	logger := h.Logger.Named(name)
+	if level, found := h.LogLevels[name]; found {
+		logger.SetLevel(level)
+	}
+	return logger
 }
 
 // getClient returns a humio client with the specified token (it can
-// be an API token or an ingest token)
-func (h *HumioPlugin) getClient(token string) *humio.Client {
+// be an API token or an ingest token).  The token is fetched from the
+// source for every request, so rotated tokens are picked up.
+func (h *HumioPlugin) getClient(token humio.TokenSource) *humio.Client {
 	client := *h.Humio // copy
-	client.Token = token
+	client.TokenSource = token
+	if client.Logger == nil {
+		client.Logger = h.subsystemLogger("client")
+	}
 	return &client
 }
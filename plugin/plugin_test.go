@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestConcurrentAccessors(t *testing.T) {
+	h := &HumioPlugin{
+		Logger:                  hclog.NewNullLogger(),
+		Humio:                   &humio.Client{},
+		PrecomputedDependencies: true,
+	}
+
+	var wg sync.WaitGroup
+	writers := make([]interface{}, 10)
+	readers := make([]interface{}, 10)
+	for i := range writers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			writers[i] = h.SpanWriter()
+			readers[i] = h.DependencyReader()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range writers {
+		if writers[i] != writers[0] || readers[i] != readers[0] {
+			t.Fatal("expected a single writer and dependency reader")
+		}
+	}
+}
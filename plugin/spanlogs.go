@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// notLogFilter excludes the span log events from queries which must
+// see each span once, such as dependencies and metrics
+const notLogFilter = "NOT kind=log"
+
+// spanLogRecord is the "log" attribute of a span log event, which is
+// decoded by the readers to put the log back into its span
+type spanLogRecord struct {
+	SpanID model.SpanID `json:"spanID"`
+	Index  int          `json:"index"`
+	model.Log
+}
+
+// LogEvents returns an event per span log, with the trace and span ID,
+// the service and operation of the span and the log fields as
+// searchable attributes.  The log is also stored as JSON in the "log"
+// attribute, and reassembled into the span by the readers.
+func (h *humioSpanWriter) LogEvents(span *model.Span) []humio.Event {
+	events := make([]humio.Event, 0, len(span.Logs))
+	for i, log := range span.Logs {
+		record, err := json.Marshal(spanLogRecord{SpanID: span.SpanID, Index: i, Log: log})
+		if err != nil {
+			h.logger.Error("json encoding of span log", "err", err)
+			continue
+		}
+
+		attributes := map[string]interface{}{
+			"log":       string(record),
+			"traceid":   span.TraceID.String(),
+			"spanid":    span.SpanID.String(),
+			"service":   span.GetProcess().GetServiceName(),
+			"operation": span.GetOperationName(),
+		}
+		h.addFields(attributes, log.Fields)
+
+		events = append(events, kindLog.event(log.Timestamp, attributes))
+	}
+	return events
+}
+
+// attachLogs decodes the newline separated "log" attributes of span
+// log events, and appends the logs to their spans in the original
+// order
+func attachLogs(spans []*model.Span, logs string) error {
+	if logs == "" {
+		return nil
+	}
+
+	var records []spanLogRecord
+	for _, line := range strings.Split(logs, "\n") {
+		if line == "" {
+			continue
+		}
+
+		var record spanLogRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return fmt.Errorf("unparsable span log from humio: %w", err)
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Index < records[j].Index })
+
+	bySpanID := make(map[model.SpanID]*model.Span, len(spans))
+	for _, span := range spans {
+		bySpanID[span.SpanID] = span
+	}
+
+	for _, record := range records {
+		// The span may be outside the time range of the query
+		if span, found := bySpanID[record.SpanID]; found {
+			span.Logs = append(span.Logs, record.Log)
+		}
+	}
+	return nil
+}
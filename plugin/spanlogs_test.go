@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestLogEvents(t *testing.T) {
+	ts := time.Unix(1665000000, 0).UTC()
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 42),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "GET /",
+		StartTime:     ts,
+		Process:       model.NewProcess("frontend", nil),
+		Logs: []model.Log{
+			{Timestamp: ts, Fields: []model.KeyValue{model.String("event", "error"), model.String("spanid", "ignored")}},
+			{Timestamp: ts.Add(time.Second), Fields: []model.KeyValue{model.Float64("retry.delay", 0.5)}},
+		},
+	}
+
+	w := testSpanWriter()
+	w.plugin.SpanLogEvents = true
+
+	event := w.SpanToEvent(span)
+	if strings.Contains(event.Attributes["payload"].(string), "retry.delay") {
+		t.Errorf("expected logs to be removed from the payload, got %s", event.Attributes["payload"])
+	}
+	if len(span.Logs) != 2 {
+		t.Error("the span was modified")
+	}
+
+	events := w.LogEvents(span)
+	if len(events) != 2 {
+		t.Fatalf("expected an event per log, got %+v", events)
+	}
+
+	first := events[0].Attributes
+	if first["kind"] != "log" || first["event"] != "error" || first["spanid"] != "0000000000000001" || first["service"] != "frontend" || first["operation"] != "GET /" {
+		t.Errorf("unexpected attributes %+v", first)
+	}
+
+	// Reassemble the logs in reverse order, as humio may return them
+	var spanPayload model.Span
+	if err := json.Unmarshal([]byte(event.Attributes["payload"].(string)), &spanPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := events[1].Attributes["log"].(string) + "\n" + first["log"].(string)
+	if err := attachLogs([]*model.Span{&spanPayload}, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spanPayload.Logs) != 2 || !spanPayload.Logs[0].Timestamp.Equal(ts) || spanPayload.Logs[1].Fields[0].GetVFloat64() != 0.5 {
+		t.Errorf("unexpected logs %+v", spanPayload.Logs)
+	}
+
+	if err := attachLogs(nil, "{"); err == nil {
+		t.Error("expected error for unparsable log")
+	}
+}
+
+func TestGetTraceSpanLogs(t *testing.T) {
+	ts := time.Unix(1665000000, 0).UTC()
+	span := &model.Span{
+		TraceID:   model.NewTraceID(0, 42),
+		SpanID:    model.NewSpanID(1),
+		StartTime: ts,
+		Process:   model.NewProcess("frontend", nil),
+	}
+	payload, err := encodePayload(span, PayloadJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := json.Marshal(spanLogRecord{SpanID: span.SpanID, Log: model.Log{Timestamp: ts, Fields: []model.KeyValue{model.String("event", "error")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q struct {
+			QueryString string `json:"queryString"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			t.Error(err)
+			return
+		}
+
+		switch {
+		case strings.Contains(q.QueryString, notLogFilter):
+			// a trace of exactly traceSpanLimit spans
+			events := make([]map[string]string, traceSpanLimit)
+			for i := range events {
+				events[i] = map[string]string{"payload": payload}
+			}
+			json.NewEncoder(w).Encode(events)
+		case strings.Contains(q.QueryString, "kind=log"):
+			json.NewEncoder(w).Encode([]map[string]string{{"log": string(record), "schema": "2"}})
+		default:
+			t.Errorf("unexpected query %s", q.QueryString)
+		}
+	}))
+	defer srv.Close()
+
+	h := &HumioPlugin{
+		Logger:    hclog.NewNullLogger(),
+		Humio:     &humio.Client{BaseURL: srv.URL, Client: &http.Client{}, QueryAPI: humio.QuerySync},
+		ReadToken: humio.StaticToken("read"),
+	}
+
+	trace, err := h.SpanReader().GetTrace(context.Background(), span.TraceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trace.Spans) != traceSpanLimit {
+		t.Fatalf("got %d spans", len(trace.Spans))
+	}
+
+	logs := 0
+	for _, span := range trace.Spans {
+		logs += len(span.Logs)
+	}
+	if logs != 1 {
+		t.Errorf("expected the log to be attached, got %d logs", logs)
+	}
+
+	if len(trace.Warnings) != 1 || !strings.Contains(trace.Warnings[0], "spans of the trace") {
+		t.Errorf("expected a warning about the span limit, got %v", trace.Warnings)
+	}
+}
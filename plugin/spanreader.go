@@ -3,35 +3,49 @@ package plugin
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
+	"regexp"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // SpanReader creates a new spanstore.Reader, which finds and loads
 // traces and other data from storage.
 func (h *HumioPlugin) SpanReader() spanstore.Reader {
-	if h.spanReader == nil {
-		h.spanReader = &humioSpanReader{plugin: h, client: h.getClient(h.ReadToken)}
-	}
+	h.spanReaderOnce.Do(func() {
+		h.spanReader = &humioSpanReader{
+			plugin:        h,
+			client:        h.getClient(h.ReadToken),
+			logger:        h.subsystemLogger("reader"),
+			repo:          h.Repo,
+			traceLookback: "14 days", // We have no idea what time this should be, so let's put our faith in bloom filters!
+		}
+	})
 	return h.spanReader
 }
 
 type humioSpanReader struct {
 	plugin *HumioPlugin
 	client *humio.Client
+	logger hclog.Logger
+	repo   string
+
+	// traceLookback is how far back GetTrace searches
+	traceLookback string
 
 	serviceOpCache struct {
 		mu          sync.RWMutex
@@ -40,48 +54,98 @@ type humioSpanReader struct {
 	}
 }
 
+// Limits of the events loaded by GetTrace.  A warning is added to the
+// trace when a limit is reached.
+const (
+	traceSpanLimit = 1000
+	traceLogLimit  = 10000
+)
+
 func (h *humioSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTrace")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "GetTrace")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetTrace")).ObserveDuration()
 
-	var q = humio.Q{
-		QueryString: "traceid=" + humio.EscapeFieldFilter(traceID.String()) + " | head(1000)",
-		Start:       humio.RelativeTime("14 days"), // We have no idea what time this should be, so let's put our faith in bloom filters!
-	}
+	traceFilter := "traceid=" + humio.EscapeFieldFilter(traceID.String())
 
-	var result []struct {
-		Timestamp int64  `json:"timestamp"`
-		Payload   string `json:"payload"`
-		TraceID   string `json:"traceid"`
+	var spanEvents []struct {
+		Payload string `json:"payload"`
+		Schema  string `json:"schema"`
 	}
-	if err := h.client.QueryDecode(ctx, h.plugin.Repo, q, &result); err != nil {
-		return nil, err
+	meta, err := h.client.QueryDecodeMeta(ctx, h.repo, humio.Q{
+		QueryString: fmt.Sprintf("%s %s | head(%d)", traceFilter, notLogFilter, traceSpanLimit),
+		Start:       humio.RelativeTime(h.traceLookback),
+	}, &spanEvents)
+	if err != nil {
+		return nil, grpcError(err)
 	}
 
-	if len(result) == 0 {
+	if len(spanEvents) == 0 {
 		return nil, spanstore.ErrTraceNotFound
 	}
 
 	var trace model.Trace
-	trace.Spans = make([]*model.Span, 0, len(result))
-	for _, event := range result {
-		var span model.Span
-		if err := json.Unmarshal([]byte(event.Payload), &span); err != nil {
-			return nil, err
+	trace.Spans = make([]*model.Span, 0, len(spanEvents))
+	for _, event := range spanEvents {
+		if err := checkSchema(event.Schema); err != nil {
+			return nil, grpcError(err)
+		}
+
+		span, err := decodePayload(event.Payload)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+
+	// The span log events are loaded separately, so they do not count
+	// towards the limit of spans.  They are read even if SpanLogEvents
+	// is off now, as it may have been on when the trace was written.
+	var logEvents []struct {
+		Log    string `json:"log"`
+		Schema string `json:"schema"`
+	}
+	logMeta, err := h.client.QueryDecodeMeta(ctx, h.repo, humio.Q{
+		QueryString: fmt.Sprintf("%s kind=%s | head(%d)", traceFilter, kindLog, traceLogLimit),
+		Start:       humio.RelativeTime(h.traceLookback),
+	}, &logEvents)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	var logs strings.Builder
+	for _, event := range logEvents {
+		if err := checkSchema(event.Schema); err != nil {
+			return nil, grpcError(err)
 		}
-		trace.Spans = append(trace.Spans, &span)
+		logs.WriteString(event.Log)
+		logs.WriteByte('\n')
+	}
+
+	if err := attachLogs(trace.Spans, logs.String()); err != nil {
+		return nil, grpcError(err)
+	}
+
+	warnings := append(queryWarnings(meta), queryWarnings(logMeta)...)
+	if len(spanEvents) == traceSpanLimit {
+		warnings = append(warnings, fmt.Sprintf("only the first %d spans of the trace are shown", traceSpanLimit))
 	}
+	if len(logEvents) == traceLogLimit {
+		warnings = append(warnings, fmt.Sprintf("only the first %d span logs of the trace are shown", traceLogLimit))
+	}
+	addWarnings(&trace, warnings)
 
 	return &trace, nil
 }
 
 func (h *humioSpanReader) GetServices(ctx context.Context) ([]string, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "GetServices")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "GetServices")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetServices")).ObserveDuration()
 
 	servicesAndOps, err := h.updateAndGetServicesAndOperations(ctx)
 	if err != nil {
-		return nil, err
+		return nil, grpcError(err)
 	}
 
 	var services []string
@@ -98,8 +162,8 @@ type serviceAndOperation struct {
 }
 
 func (h *humioSpanReader) getServicesAndOperations(ctx context.Context, updated time.Time) ([]serviceAndOperation, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "getServicesAndOperations")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "getServicesAndOperations")
+	defer span.End()
 	var queryStart *humio.QueryTime
 	if updated.IsZero() {
 		queryStart = humio.RelativeTime("1 day")
@@ -108,7 +172,7 @@ func (h *humioSpanReader) getServicesAndOperations(ctx context.Context, updated
 	}
 
 	var results []serviceAndOperation
-	err := h.client.QueryDecode(ctx, h.plugin.Repo, humio.Q{
+	err := h.client.QueryDecode(ctx, h.repo, humio.Q{
 		QueryString: "groupBy(service, function=groupBy(operation))",
 		Start:       queryStart,
 	}, &results)
@@ -122,8 +186,10 @@ func (h *humioSpanReader) updateAndGetServicesAndOperations(ctx context.Context)
 	h.serviceOpCache.mu.RUnlock()
 
 	if time.Since(updated) < 30*time.Second {
+		metrics.CacheResult("serviceops", true)
 		return cached, nil
 	}
+	metrics.CacheResult("serviceops", false)
 
 	h.serviceOpCache.mu.Lock()
 	defer h.serviceOpCache.mu.Unlock()
@@ -162,21 +228,21 @@ func (h *humioSpanReader) updateAndGetServicesAndOperations(ctx context.Context)
 }
 
 func (h *humioSpanReader) GetOperations(ctx context.Context, q spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "GetOperations")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "GetOperations")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("GetOperations")).ObserveDuration()
 
 	defer func() {
 		if r := recover(); r != nil {
-			h.plugin.Logger.Error(fmt.Sprintf("%+v", r))
-			h.plugin.Logger.Error(string(debug.Stack()))
-			span.LogKV("error", r)
-			ext.Error.Set(span, true)
+			h.logger.Error(fmt.Sprintf("%+v", r))
+			h.logger.Error(string(debug.Stack()))
+			span.SetStatus(otelcodes.Error, fmt.Sprint(r))
 		}
 	}()
 
 	servicesAndOps, err := h.updateAndGetServicesAndOperations(ctx)
 	if err != nil {
-		return nil, err
+		return nil, grpcError(err)
 	}
 
 	var ret []spanstore.Operation
@@ -191,36 +257,29 @@ func (h *humioSpanReader) GetOperations(ctx context.Context, q spanstore.Operati
 	return ret, nil
 }
 
-func (h *humioSpanReader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]string, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "findTraceIDs")
-	defer span.Finish()
+func (h *humioSpanReader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]string, *humio.QueryMetadata, error) {
+	ctx, span := tracer.Start(ctx, "findTraceIDs")
+	defer span.End()
 
 	if query.NumTraces == 0 {
 		query.NumTraces = 20
 	}
 
-	tags := make(map[string]string)
-	for k, v := range query.Tags {
-		tags[k] = v
-	}
-
+	// Find trace IDs of matching spans
+	var queryPrefix = &bytes.Buffer{}
 	if query.ServiceName != "" {
-		tags[`service`] = query.ServiceName
+		fmt.Fprintf(queryPrefix, `service="%s" `, humio.EscapeFieldFilter(query.ServiceName))
 	}
 
 	if query.OperationName != "" {
-		tags[`operation`] = query.OperationName
+		fmt.Fprintf(queryPrefix, `operation="%s" `, humio.EscapeFieldFilter(query.OperationName))
 	}
 
-	// Find trace IDs of matching spans
-	var queryPrefix = &bytes.Buffer{}
-	for k, v := range tags {
-		queryPrefix.WriteString(k)
-		queryPrefix.WriteString(`="`)
-		v = humio.EscapeFieldFilter(v)
-		queryPrefix.WriteString(v)
-		queryPrefix.WriteString(`" `)
+	tags, err := tagFilter(query.Tags)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	queryPrefix.WriteString(tags)
 
 	if query.DurationMin.Nanoseconds() != 0 {
 		fmt.Fprintf(queryPrefix, "duration_ms > %v ", query.DurationMin.Milliseconds())
@@ -242,8 +301,9 @@ func (h *humioSpanReader) findTraceIDs(ctx context.Context, query *spanstore.Tra
 		TraceID string `json:"traceid"`
 	}
 
-	if err := h.client.QueryDecode(ctx, h.plugin.Repo, q, &result); err != nil {
-		return nil, err
+	meta, err := h.client.QueryDecodeMeta(ctx, h.repo, q, &result)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	ret := make([]string, 0, len(result))
@@ -251,25 +311,25 @@ func (h *humioSpanReader) findTraceIDs(ctx context.Context, query *spanstore.Tra
 		ret = append(ret, event.TraceID)
 	}
 
-	return ret, nil
+	return ret, meta, nil
 }
 
 func (h *humioSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraces")
-	defer span.Finish()
+	ctx, span := tracer.Start(ctx, "FindTraces")
+	defer span.End()
+	defer prometheus.NewTimer(metrics.QueryDuration.WithLabelValues("FindTraces")).ObserveDuration()
 
 	defer func() {
 		if r := recover(); r != nil {
-			h.plugin.Logger.Error(fmt.Sprintf("%+v", r))
-			h.plugin.Logger.Error(string(debug.Stack()))
-			span.LogKV("error", r)
-			ext.Error.Set(span, true)
+			h.logger.Error(fmt.Sprintf("%+v", r))
+			h.logger.Error(string(debug.Stack()))
+			span.SetStatus(otelcodes.Error, fmt.Sprint(r))
 		}
 	}()
 
-	traceIDs, err := h.findTraceIDs(ctx, query)
+	traceIDs, idMeta, err := h.findTraceIDs(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, grpcError(err)
 	}
 
 	if len(traceIDs) == 0 {
@@ -288,7 +348,7 @@ func (h *humioSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 	queryPrefix.WriteByte(')')
 
 	var q = humio.Q{
-		QueryString: queryPrefix.String() + `| groupBy(field=traceid, function=session(maxpause=5m, collect([payload], multival=true)))`,
+		QueryString: queryPrefix.String() + `| groupBy(field=traceid, function=session(maxpause=5m, collect([payload, log, schema], multival=true)))`,
 		Start:       humio.AbsoluteTime(query.StartTimeMin),
 		End:         humio.AbsoluteTime(query.StartTimeMax),
 	}
@@ -297,29 +357,35 @@ func (h *humioSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 		Timestamp int64  `json:"timestamp"`
 		Payload   string `json:"payload"`
 		TraceID   string `json:"traceid"`
+		Schema    string `json:"schema"`
+		Log       string `json:"log"`
 	}
 
-	if err := h.client.QueryDecode(ctx, h.plugin.Repo, q, &result); err != nil {
-		return nil, err
+	meta, err := h.client.QueryDecodeMeta(ctx, h.repo, q, &result)
+	if err != nil {
+		return nil, grpcError(err)
 	}
-	span.LogKV("event", "backend query complete")
+	span.AddEvent("backend query complete")
+
+	warnings := append(queryWarnings(idMeta), queryWarnings(meta)...)
 
 	ret := make([]*model.Trace, 0, len(result))
 	for _, event := range result {
-		var trace model.Trace
-		dec := json.NewDecoder(strings.NewReader(event.Payload))
-	loop:
-		for {
-			var span model.Span
-			switch err := dec.Decode(&span); err {
-			case nil:
-				trace.Spans = append(trace.Spans, &span)
-			case io.EOF:
-				break loop
-			default: // unexpected error
-				return nil, err
-			}
+		if err := checkSchema(event.Schema); err != nil {
+			return nil, grpcError(err)
 		}
+
+		spans, err := decodePayloads(event.Payload)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		trace := model.Trace{Spans: spans}
+
+		if err := attachLogs(trace.Spans, event.Log); err != nil {
+			return nil, grpcError(err)
+		}
+		addWarnings(&trace, warnings)
 		ret = append(ret, &trace)
 	}
 
@@ -327,11 +393,85 @@ func (h *humioSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 }
 
 func (h *humioSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "FindTraceIDs")
-	defer span.Finish()
+	_, span := tracer.Start(ctx, "FindTraceIDs")
+	defer span.End()
 
-	h.plugin.Logger.Warn("FindTraceIDs " + fmt.Sprintf("%+v", query))
-	return nil, errors.New("not implemented") // TODO: Implement
+	h.logger.Debug("FindTraceIDs " + fmt.Sprintf("%+v", query))
+	return nil, status.Error(codes.Unimplemented, "not implemented") // TODO: Implement
+}
+
+// tagFilter returns a humio filter matching spans with all the tags,
+// written with any schema version, for example
+// (http.method="GET" OR tag.http.method="GET").  Tag keys are mapped to
+// the stored fields, so a tag named "service" is matched as "_service"
+// in version 1, and not as the service of the span.  Keys which are
+// not plain field names are rejected, as they cannot be quoted in a
+// humio filter.
+func tagFilter(tags map[string]string) (string, error) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		if !tagKeyPattern.MatchString(k) {
+			return "", fmt.Errorf("unsupported tag key %q, only letters, digits and _.@#- are supported", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		v := humio.EscapeFieldFilter(tags[k])
+		fmt.Fprintf(&sb, `(%s="%s" OR %s%s="%s") `, v1TagField(k), v, tagPrefix, k, v)
+	}
+	return sb.String(), nil
+}
+
+// tagKeyPattern matches the tag keys which can be used as field names
+// in a humio filter
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.@#-]+$`)
+
+// checkSchema returns an error for events written with a schema
+// version newer than this plugin knows, see SchemaV2.  schema is the
+// "schema" attribute of an event, or the newline separated values
+// collected from the events of a trace.
+func checkSchema(schema string) error {
+	for _, version := range strings.Split(schema, "\n") {
+		switch strings.TrimSpace(version) {
+		case "", strconv.Itoa(SchemaV1), strconv.Itoa(SchemaV2):
+		default:
+			return fmt.Errorf("unsupported event schema version %q, upgrade the plugin", version)
+		}
+	}
+	return nil
+}
+
+// queryWarnings returns warnings from humio, and a warning if the
+// results are partial because the query did not complete in time.
+func queryWarnings(meta *humio.QueryMetadata) []string {
+	if meta == nil {
+		return nil
+	}
+
+	warnings := append([]string(nil), meta.Warnings...)
+	if !meta.Done {
+		warnings = append(warnings, fmt.Sprintf("humio search did not complete in time, results may be incomplete (%d of %d work units done, %d events processed)",
+			meta.WorkDone, meta.TotalWork, meta.ProcessedEvents))
+	}
+
+	return warnings
+}
+
+// addWarnings adds the warnings to the trace.  As the jaeger plugin
+// protocol only transfers spans, they are also added to the first span
+// to make sure they are displayed in the UI.
+func addWarnings(trace *model.Trace, warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+
+	trace.Warnings = append(trace.Warnings, warnings...)
+	if len(trace.Spans) > 0 {
+		trace.Spans[0].Warnings = append(trace.Spans[0].Warnings, warnings...)
+	}
 }
 
 // Assert that we implement the right interface
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestQueryWarnings(t *testing.T) {
+	if w := queryWarnings(&humio.QueryMetadata{Done: true}); len(w) != 0 {
+		t.Errorf("unexpected warnings for complete results: %v", w)
+	}
+
+	w := queryWarnings(&humio.QueryMetadata{Done: false, WorkDone: 1, TotalWork: 4, Warnings: []string{"from humio"}})
+	if len(w) != 2 || w[0] != "from humio" || !strings.Contains(w[1], "1 of 4") {
+		t.Errorf("unexpected warnings for partial results: %v", w)
+	}
+}
+
+func TestAddWarnings(t *testing.T) {
+	trace := &model.Trace{Spans: []*model.Span{{}, {}}}
+	addWarnings(trace, []string{"truncated"})
+
+	if len(trace.Warnings) != 1 || len(trace.Spans[0].Warnings) != 1 || len(trace.Spans[1].Warnings) != 0 {
+		t.Errorf("unexpected warnings %+v", trace)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	got, err := tagFilter(map[string]string{"http.method": "GET", "error": `say "hi"`, "service": "redis"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `(error="say \"hi\"" OR tag.error="say \"hi\"") (http.method="GET" OR tag.http.method="GET") (_service="redis" OR tag.service="redis") `
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	for _, key := range []string{`a="b" OR x`, "a b", "a|head(1)", "a=b", ""} {
+		if _, err := tagFilter(map[string]string{key: "v"}); err == nil {
+			t.Errorf("expected error for tag key %q", key)
+		}
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	for _, schema := range []string{"", "1", "2", "1\n2\n"} {
+		if err := checkSchema(schema); err != nil {
+			t.Errorf("unexpected error for schema %q: %v", schema, err)
+		}
+	}
+
+	for _, schema := range []string{"3", "2\n3"} {
+		if err := checkSchema(schema); err == nil {
+			t.Errorf("expected error for unknown schema %q", schema)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package plugin
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/metrics"
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 )
@@ -15,24 +21,111 @@ import (
 // SpanWriter creates a new spanstore.Writer which can write spans to
 // humio
 func (h *HumioPlugin) SpanWriter() spanstore.Writer {
-	if h.spanWriter == nil {
-		client := h.getClient(h.WriteToken)
-		h.spanWriter = &humioSpanWriter{
-			plugin: h,
-			ingest: &humio.BatchIngester{Client: client},
-		}
+	h.spanWriterOnce.Do(func() {
+		h.spanWriter = h.newSpanWriter(h.WriteToken, h.subsystemLogger("ingest"))
+	})
+	return h.spanWriter
+}
+
+// newSpanWriter creates a span writer ingesting with the given token,
+// which also selects the repository
+func (h *HumioPlugin) newSpanWriter(token humio.TokenSource, logger hclog.Logger) *humioSpanWriter {
+	client := h.getClient(token)
+	client.DisableTracing = !h.TraceIngest
+	w := &humioSpanWriter{
+		plugin: h,
+		ingest: &humio.BatchIngester{Client: client},
+		logger: logger,
+		done:   make(chan struct{}),
+	}
 
-		// Create a background goroutine to sync events to humio in batches
-		go func() {
-			for {
-				time.Sleep(1 * time.Second)
-				if err := h.spanWriter.ingest.Flush(context.Background()); err != nil {
-					h.Logger.Error("Flush to humio failed", "err", err)
-				}
+	// Create a background goroutine to sync events to humio in batches,
+	// until the writer is closed
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
 			}
-		}()
+			if err := w.ingest.Flush(context.Background()); err != nil {
+				w.logger.Error("Flush to humio failed", "err", err)
+			}
+		}
+	}()
+
+	return w
+}
+
+// Versions of the span events.  Version 1 stores tags as string
+// attributes named after the tag, and skips float and binary tags.
+// Version 2 stores every tag under tagPrefix with its native JSON type,
+// and records the version in schemaField.  Both store the full span as
+// JSON in "payload", so the readers decode either version.
+const (
+	SchemaV1 = 1
+	SchemaV2 = 2
+
+	schemaField = "schema"
+	tagPrefix   = "tag."
+)
+
+// reservedFields are the attributes written by the plugin, on span
+// events and on span log events.  Tags never overwrite them: schema
+// version 2 stores tags under tagPrefix, and version 1 renames the
+// colliding ones, see v1TagField.
+var reservedFields = map[string]struct{}{
+	"payload":     {},
+	"traceid":     {},
+	"spanid":      {},
+	"refs":        {},
+	"service":     {},
+	"operation":   {},
+	"duration_ms": {},
+	"kind":        {},
+	"log":         {},
+	schemaField:   {},
+}
+
+// eventKind is the "kind" of the events written besides the spans,
+// such as span logs and dependencies.  It is a humio tag, which keeps
+// the events apart from the span events, and also an attribute, as
+// tags are not available with HEC ingest.
+type eventKind string
+
+const (
+	kindLog          eventKind = "log"
+	kindDependencies eventKind = "dependencies"
+)
+
+// tags returns the humio tags of events of this kind
+func (k eventKind) tags() map[string]string {
+	return map[string]string{"kind": string(k)}
+}
+
+// event returns an event of this kind, setting the "kind" attribute
+func (k eventKind) event(ts time.Time, attributes map[string]interface{}) humio.Event {
+	attributes["kind"] = string(k)
+	return humio.Event{
+		Timestamp:  humio.IngestTime{Time: ts},
+		Attributes: attributes,
 	}
-	return h.spanWriter
+}
+
+// v1TagField returns the attribute of a tag or log field in schema
+// version 1.  Keys colliding with reservedFields or with the fields of
+// humio itself (starting with @ or #) are prefixed by an underscore,
+// such as "_service", instead of overwriting them.  A tag literally
+// named "_service" then shares the field with a renamed "service" tag,
+// and only the first value is written, so use schema version 2 when
+// that matters.
+func v1TagField(key string) string {
+	if _, reserved := reservedFields[key]; reserved || strings.HasPrefix(key, "@") || strings.HasPrefix(key, "#") {
+		return "_" + key
+	}
+	return key
 }
 
 func TagValueString(tag model.KeyValue) (string, bool) {
@@ -52,65 +145,183 @@ func TagValueString(tag model.KeyValue) (string, bool) {
 	}
 }
 
+// TagValueNative returns the tag value with its own type, as encoded
+// in JSON.  Binary values are base64 encoded, and floats JSON cannot
+// represent (NaN and infinities) are formatted as strings.
+func TagValueNative(tag model.KeyValue) interface{} {
+	switch tag.GetVType() {
+	case model.ValueType_INT64:
+		return tag.GetVInt64()
+	case model.ValueType_BOOL:
+		return tag.GetVBool()
+	case model.ValueType_FLOAT64:
+		f := tag.GetVFloat64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return f
+	case model.ValueType_BINARY:
+		return base64.StdEncoding.EncodeToString(tag.GetVBinary())
+	default:
+		return tag.GetVStr()
+	}
+}
+
+// ReferencesString encodes all span references as a space separated
+// list of "REF_TYPE:spanid", for example "CHILD_OF:00000000000004d2
+// FOLLOWS_FROM:000000000000162e".  The format is stable, as it is
+// parsed by the dependency queries.
+func ReferencesString(refs []model.SpanRef) string {
+	var sb strings.Builder
+	for i, ref := range refs {
+		if i != 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(ref.GetRefType().String())
+		sb.WriteByte(':')
+		sb.WriteString(ref.SpanID.String())
+	}
+	return sb.String()
+}
+
+// ParseReferencesString parses the output of ReferencesString.  As
+// only span IDs are stored, the trace IDs of the returned references
+// are left empty.
+func ParseReferencesString(s string) ([]model.SpanRef, error) {
+	var refs []model.SpanRef
+	for _, field := range strings.Fields(s) {
+		refType, spanID, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed reference %q", field)
+		}
+
+		t, ok := model.SpanRefType_value[refType]
+		if !ok {
+			return nil, fmt.Errorf("unknown reference type %q", refType)
+		}
+
+		id, err := model.SpanIDFromString(spanID)
+		if err != nil {
+			return nil, fmt.Errorf("reference %q: %w", field, err)
+		}
+
+		refs = append(refs, model.SpanRef{RefType: model.SpanRefType(t), SpanID: id})
+	}
+	return refs, nil
+}
+
 func (h *humioSpanWriter) SpanToEvent(span *model.Span) humio.Event {
 	t := span.GetStartTime()
 
 	// TODO: drop this?  I think humio returns an error if the timestamp is in the future (seen in syslog)
 	if t.After(time.Now()) {
-		h.plugin.Logger.Error("Fixing timestamp", "ts", time.Since(t))
+		h.logger.Warn("Fixing timestamp", "ts", time.Since(t))
 		t = time.Now().Local()
 	}
 
-	buf := &bytes.Buffer{}
-	// TODO: Consider creating a humio event per log event inside the span
+	if h.plugin.SpanLogEvents && len(span.Logs) > 0 {
+		// The logs are written as separate events, see LogEvents
+		withoutLogs := *span
+		withoutLogs.Logs = nil
+		span = &withoutLogs
+	}
+
 	// TODO: Consider dropping some internal tags
-	// TODO: Consider mapping tags as pure JSON k: v / map[string]string
-	err := json.NewEncoder(buf).Encode(span)
+	payload, err := encodePayload(span, h.plugin.PayloadEncoding)
 	if err != nil {
-		h.plugin.Logger.Error("json encoding", "err", err)
+		h.logger.Error("payload encoding", "encoding", h.plugin.PayloadEncoding, "err", err)
 		return humio.Event{}
 	}
 	event := humio.Event{
 		Timestamp: humio.IngestTime{Time: t},
-		Attributes: map[string]string{
-			"payload": buf.String(),
-			"traceid": span.TraceID.String(),
+		Attributes: map[string]interface{}{
+			"payload":     payload,
+			"traceid":     span.TraceID.String(),
+			"spanid":      span.SpanID.String(),
+			"service":     span.GetProcess().GetServiceName(),
+			"operation":   span.GetOperationName(),
+			"duration_ms": fmt.Sprintf("%d", span.GetDuration().Milliseconds()),
 		},
 	}
 
+	if refs := ReferencesString(span.References); refs != "" {
+		event.Attributes["refs"] = refs
+	}
+
 	var tags []model.KeyValue
 	tags = append(tags, span.Tags...)
 	tags = append(tags, span.Process.Tags...)
+	h.addFields(event.Attributes, tags)
 
-	for _, tag := range tags {
-		k := tag.GetKey()
-		if _, reserved := event.Attributes[k]; reserved {
-			// don't overwrite existing attributes.  TODO: prepend _ here and in search?
+	return event
+}
+
+// addFields adds the tags or log fields as searchable attributes,
+// according to the schema version.  Existing attributes are kept, so
+// span tags take precedence over process tags.
+func (h *humioSpanWriter) addFields(attributes map[string]interface{}, fields []model.KeyValue) {
+	if h.plugin.SchemaVersion >= SchemaV2 {
+		attributes[schemaField] = SchemaV2
+		for _, field := range fields {
+			k := tagPrefix + field.GetKey()
+			if _, exists := attributes[k]; !exists {
+				attributes[k] = TagValueNative(field)
+			}
+		}
+		return
+	}
+
+	for _, field := range fields {
+		k := v1TagField(field.GetKey())
+		if _, exists := attributes[k]; exists {
+			// the first value wins, as in version 2
 			continue
 		}
 
-		if v, ok := TagValueString(tag); ok {
-			event.Attributes[k] = v
+		if v, ok := TagValueString(field); ok {
+			attributes[k] = v
 		}
 	}
-
-	return event
 }
 
 type humioSpanWriter struct {
 	plugin *HumioPlugin
 	ingest *humio.BatchIngester
+	logger hclog.Logger
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close stops the periodic flush and flushes the buffered events.  It
+// is called by jaeger when the collector shuts down.
+func (h *humioSpanWriter) Close() error {
+	h.closeOnce.Do(func() { close(h.done) })
+	return h.ingest.Flush(context.Background())
 }
 
 func (h *humioSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	metrics.SpansReceived.Inc()
 	event := h.SpanToEvent(span)
-	event.Attributes["service"] = span.GetProcess().GetServiceName()
-	event.Attributes["operation"] = span.GetOperationName()
-	event.Attributes["duration_ms"] = fmt.Sprintf("%d", span.GetDuration().Milliseconds())
+	if event.Attributes == nil {
+		metrics.SpansDropped.WithLabelValues("encoding").Inc()
+		return fmt.Errorf("encoding span %s failed", span.SpanID)
+	}
+	metrics.SpansEncoded.Inc()
 
 	h.ingest.AddEvent(map[string]string{}, event)
+
+	if h.plugin.SpanLogEvents {
+		for _, logEvent := range h.LogEvents(span) {
+			h.ingest.AddEvent(kindLog.tags(), logEvent)
+		}
+	}
 	return nil
 }
 
-// Assert that we implement the upstream interface
-var _ spanstore.Writer = &humioSpanWriter{}
+// Assert that we implement the upstream interface, and support the
+// graceful shutdown of jaeger
+var (
+	_ spanstore.Writer = &humioSpanWriter{}
+	_ io.Closer        = &humioSpanWriter{}
+)
@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func testSpanWriter() *humioSpanWriter {
+	return &humioSpanWriter{plugin: &HumioPlugin{}, logger: hclog.NewNullLogger()}
+}
+
+func TestSpanToEventReferences(t *testing.T) {
+	traceID := model.NewTraceID(0, 42)
+	span := &model.Span{
+		TraceID:   traceID,
+		SpanID:    model.NewSpanID(3),
+		StartTime: time.Now().Add(-time.Minute),
+		Process:   model.NewProcess("consumer", nil),
+		References: []model.SpanRef{
+			model.NewChildOfRef(traceID, model.NewSpanID(1)),
+			model.NewFollowsFromRef(traceID, model.NewSpanID(2)),
+		},
+	}
+
+	event := testSpanWriter().SpanToEvent(span)
+
+	if got, want := event.Attributes["spanid"], "0000000000000003"; got != want {
+		t.Errorf("spanid = %q, want %q", got, want)
+	}
+
+	if got, want := event.Attributes["refs"], "CHILD_OF:0000000000000001 FOLLOWS_FROM:0000000000000002"; got != want {
+		t.Errorf("refs = %q, want %q", got, want)
+	}
+}
+
+func TestSpanToEventNoReferences(t *testing.T) {
+	span := &model.Span{
+		TraceID:   model.NewTraceID(0, 42),
+		SpanID:    model.NewSpanID(1),
+		StartTime: time.Now().Add(-time.Minute),
+		Process:   model.NewProcess("root", nil),
+	}
+
+	event := testSpanWriter().SpanToEvent(span)
+	if refs, exists := event.Attributes["refs"]; exists {
+		t.Errorf("unexpected refs attribute %q on root span", refs)
+	}
+}
+
+func TestSpanToEventReservedTags(t *testing.T) {
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 42),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "GET /",
+		StartTime:     time.Now().Add(-time.Minute),
+		Duration:      1500 * time.Millisecond,
+		Tags: []model.KeyValue{
+			model.String("service", "redis"),
+			model.String("payload", "not a payload"),
+			model.String("@timestamp", "yesterday"),
+			model.String("component", "net/http"),
+		},
+		Process: model.NewProcess("frontend", []model.KeyValue{model.String("service", "process")}),
+	}
+
+	event := testSpanWriter().SpanToEvent(span)
+
+	for k, want := range map[string]interface{}{
+		"service":     "frontend",
+		"operation":   "GET /",
+		"duration_ms": "1500",
+		"_service":    "redis",
+		"_payload":    "not a payload",
+		"_@timestamp": "yesterday",
+		"component":   "net/http",
+	} {
+		if got := event.Attributes[k]; got != want {
+			t.Errorf("%s = %#v, want %#v", k, got, want)
+		}
+	}
+
+	if _, exists := event.Attributes["@timestamp"]; exists {
+		t.Errorf("unexpected @timestamp attribute")
+	}
+}
+
+func TestSpanToEventSchemaV2(t *testing.T) {
+	span := &model.Span{
+		TraceID:   model.NewTraceID(0, 42),
+		SpanID:    model.NewSpanID(1),
+		StartTime: time.Now().Add(-time.Minute),
+		Tags: []model.KeyValue{
+			model.String("payload", "not a payload"),
+			model.Int64("http.status_code", 200),
+			model.Bool("error", true),
+			model.Float64("ratio", 0.5),
+			model.Binary("id", []byte{1, 2}),
+			model.String("hostname", "span"),
+		},
+		Process: model.NewProcess("root", []model.KeyValue{model.String("hostname", "process")}),
+	}
+
+	w := testSpanWriter()
+	w.plugin.SchemaVersion = SchemaV2
+	event := w.SpanToEvent(span)
+
+	for k, want := range map[string]interface{}{
+		"schema":               SchemaV2,
+		"tag.payload":          "not a payload",
+		"tag.http.status_code": int64(200),
+		"tag.error":            true,
+		"tag.ratio":            0.5,
+		"tag.id":               "AQI=",
+		"tag.hostname":         "span",
+	} {
+		if got := event.Attributes[k]; got != want {
+			t.Errorf("%s = %#v, want %#v", k, got, want)
+		}
+	}
+
+	if _, err := json.Marshal(event); err != nil {
+		t.Errorf("event cannot be encoded: %v", err)
+	}
+
+	if payload, ok := event.Attributes["payload"].(string); !ok || !strings.HasPrefix(payload, "{") {
+		t.Errorf("unexpected payload %v", event.Attributes["payload"])
+	}
+}
+
+func TestTagValueNativeNaN(t *testing.T) {
+	if v := TagValueNative(model.Float64("nan", math.NaN())); v != "NaN" {
+		t.Errorf("expected NaN as a string, got %#v", v)
+	}
+}
+
+func TestParseReferencesString(t *testing.T) {
+	refs, err := ParseReferencesString("CHILD_OF:0000000000000001 FOLLOWS_FROM:0000000000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 2 {
+		t.Fatalf("got %d references, want 2", len(refs))
+	}
+
+	if refs[0].RefType != model.SpanRefType_CHILD_OF || refs[0].SpanID != model.NewSpanID(1) {
+		t.Errorf("unexpected first reference %+v", refs[0])
+	}
+
+	if refs[1].RefType != model.SpanRefType_FOLLOWS_FROM || refs[1].SpanID != model.NewSpanID(2) {
+		t.Errorf("unexpected second reference %+v", refs[1])
+	}
+
+	for _, bad := range []string{"CHILD_OF", "PARENT_OF:0000000000000001", "CHILD_OF:xyz"} {
+		if _, err := ParseReferencesString(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSpanWriterClose(t *testing.T) {
+	var mu sync.Mutex
+	var ingested int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var streams []struct {
+			Events []json.RawMessage `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&streams); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range streams {
+			ingested += len(s.Events)
+		}
+	}))
+	defer srv.Close()
+
+	h := &HumioPlugin{
+		Logger:     hclog.NewNullLogger(),
+		Humio:      &humio.Client{BaseURL: srv.URL, Client: &http.Client{}},
+		WriteToken: humio.StaticToken("write"),
+	}
+
+	w := h.SpanWriter()
+	span := &model.Span{TraceID: model.NewTraceID(0, 42), SpanID: model.NewSpanID(1), Process: model.NewProcess("frontend", nil)}
+	if err := w.WriteSpan(context.Background(), span); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close flushes without waiting for the periodic flush
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ingested != 1 {
+		t.Errorf("got %d events, want 1", ingested)
+	}
+}
@@ -0,0 +1,17 @@
+package plugin
+
+import (
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// StreamingSpanWriter returns the writer used when the collector
+// streams spans to the plugin instead of making one gRPC call per
+// span.  WriteSpan only adds the span to the BatchIngester, so the
+// stream shares the writer (and batches) of SpanWriter.
+func (h *HumioPlugin) StreamingSpanWriter() spanstore.Writer {
+	return h.SpanWriter()
+}
+
+// Assert that we implement the upstream interface
+var _ shared.StreamingSpanWriterPlugin = &HumioPlugin{}
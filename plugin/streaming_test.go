@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// benchmarkWriters returns the unary and streaming writers of a
+// plugin served over an in-memory gRPC connection, like jaeger would
+// use them, with a humio discarding all events
+func benchmarkWriters(b *testing.B) (unary, streaming spanstore.Writer) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	b.Cleanup(srv.Close)
+
+	h := &HumioPlugin{
+		Logger:     hclog.NewNullLogger(),
+		Humio:      &humio.Client{BaseURL: srv.URL, Client: &http.Client{}},
+		WriteToken: humio.StaticToken("write"),
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	if err := shared.NewGRPCHandlerWithPlugins(h, nil, h).Register(server); err != nil {
+		b.Fatal(err)
+	}
+	go server.Serve(lis)
+	b.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	// stop the periodic flush of the writer when the benchmark is done
+	b.Cleanup(func() { h.SpanWriter().(io.Closer).Close() })
+
+	client := shared.NewGRPCClient(conn)
+	return client.SpanWriter(), client.StreamingSpanWriter()
+}
+
+func benchmarkWriteSpan(b *testing.B, writer spanstore.Writer) {
+	span := &model.Span{
+		TraceID:       model.NewTraceID(1, 2),
+		SpanID:        model.NewSpanID(3),
+		OperationName: "GET /api/orders",
+		StartTime:     time.Now(),
+		Duration:      12 * time.Millisecond,
+		Tags:          []model.KeyValue{model.String("http.method", "GET"), model.Int64("http.status_code", 200)},
+		Process:       model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "frontend-1")}),
+		References:    []model.SpanRef{model.NewChildOfRef(model.NewTraceID(1, 2), model.NewSpanID(4))},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := writer.WriteSpan(context.Background(), span); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkWriteSpanUnary(b *testing.B) {
+	unary, _ := benchmarkWriters(b)
+	benchmarkWriteSpan(b, unary)
+}
+
+func BenchmarkWriteSpanStreaming(b *testing.B) {
+	_, streaming := benchmarkWriters(b)
+	benchmarkWriteSpan(b, streaming)
+}
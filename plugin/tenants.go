@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/chlunde/humio-jaeger-storage/health"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/tenancy"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	jaegermetrics "github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTenantHeader is the gRPC metadata carrying the tenant, the
+// same default as jaeger's --multi-tenancy.header
+const DefaultTenantHeader = "x-tenant"
+
+// TenantRouter serves several tenants from one process.  Each call is
+// routed to the HumioPlugin of the tenant in the context, so every
+// tenant has its own repository, tokens, ingest buffers and caches.
+// Calls without a known tenant are rejected.
+type TenantRouter struct {
+	Tenants map[string]*HumioPlugin
+
+	// Header is the gRPC metadata read if the tenant is not in the
+	// context, default DefaultTenantHeader
+	Header string
+}
+
+// Tenant returns the plugin of the tenant set in ctx by jaeger's
+// tenancy package, or in the incoming gRPC metadata
+func (r *TenantRouter) Tenant(ctx context.Context) (*HumioPlugin, error) {
+	tenant := tenancy.GetTenant(ctx)
+	if tenant == "" {
+		header := r.Header
+		if header == "" {
+			header = DefaultTenantHeader
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		tenants := md.Get(header)
+		if len(tenants) != 1 {
+			return nil, status.Errorf(codes.PermissionDenied, "missing tenant header")
+		}
+		tenant = tenants[0]
+	}
+
+	h, found := r.Tenants[tenant]
+	if !found {
+		return nil, status.Errorf(codes.PermissionDenied, "unknown tenant")
+	}
+	return h, nil
+}
+
+func (r *TenantRouter) spanReader(ctx context.Context) (spanstore.Reader, error) {
+	h, err := r.Tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.SpanReader(), nil
+}
+
+func (r *TenantRouter) spanWriter(ctx context.Context) (spanstore.Writer, error) {
+	h, err := r.Tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.SpanWriter(), nil
+}
+
+func (r *TenantRouter) dependencyReader(ctx context.Context) (dependencystore.Reader, error) {
+	h, err := r.Tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.DependencyReader(), nil
+}
+
+func (r *TenantRouter) metricsReader(ctx context.Context) (metricsstore.Reader, error) {
+	h, err := r.Tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.MetricsReader(), nil
+}
+
+// SpanReader returns a spanstore.Reader routing to the tenant's reader
+func (r *TenantRouter) SpanReader() spanstore.Reader {
+	return &tenantSpanReader{r}
+}
+
+// SpanWriter returns a spanstore.Writer routing to the tenant's writer
+func (r *TenantRouter) SpanWriter() spanstore.Writer {
+	return &tenantSpanWriter{r}
+}
+
+// StreamingSpanWriter returns the same writer as SpanWriter, see
+// HumioPlugin.StreamingSpanWriter
+func (r *TenantRouter) StreamingSpanWriter() spanstore.Writer {
+	return r.SpanWriter()
+}
+
+// DependencyReader returns a dependencystore.Reader routing to the
+// tenant's reader
+func (r *TenantRouter) DependencyReader() dependencystore.Reader {
+	return &tenantDependencyReader{r}
+}
+
+// MetricsReader returns a metricsstore.Reader routing to the tenant's
+// reader
+func (r *TenantRouter) MetricsReader() metricsstore.Reader {
+	return &tenantMetricsReader{r}
+}
+
+// HealthChecker checks that humio is up, and the tokens of every
+// tenant, see HumioPlugin.HealthChecker.  The checks of the tokens are
+// named after the tenant, such as "team-a/read".
+func (r *TenantRouter) HealthChecker(interval time.Duration) *health.Checker {
+	names := make([]string, 0, len(r.Tenants))
+	for name := range r.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	first := r.Tenants[names[0]]
+	checks := map[string]health.Check{"status": first.statusCheck()}
+	for _, name := range names {
+		read, write := r.Tenants[name].tokenChecks()
+		checks[name+"/read"] = read
+		checks[name+"/write"] = write
+	}
+
+	return &health.Checker{
+		Checks:   checks,
+		Interval: interval,
+		Logger:   first.subsystemLogger("health"),
+	}
+}
+
+type tenantSpanReader struct {
+	router *TenantRouter
+}
+
+func (t *tenantSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	reader, err := t.router.spanReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetTrace(ctx, traceID)
+}
+
+func (t *tenantSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	reader, err := t.router.spanReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetServices(ctx)
+}
+
+func (t *tenantSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	reader, err := t.router.spanReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetOperations(ctx, query)
+}
+
+func (t *tenantSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	reader, err := t.router.spanReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.FindTraces(ctx, query)
+}
+
+func (t *tenantSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	reader, err := t.router.spanReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.FindTraceIDs(ctx, query)
+}
+
+type tenantSpanWriter struct {
+	router *TenantRouter
+}
+
+func (t *tenantSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	writer, err := t.router.spanWriter(ctx)
+	if err != nil {
+		return err
+	}
+	return writer.WriteSpan(ctx, span)
+}
+
+type tenantDependencyReader struct {
+	router *TenantRouter
+}
+
+func (t *tenantDependencyReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	reader, err := t.router.dependencyReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetDependencies(ctx, endTs, lookback)
+}
+
+type tenantMetricsReader struct {
+	router *TenantRouter
+}
+
+func (t *tenantMetricsReader) GetLatencies(ctx context.Context, params *metricsstore.LatenciesQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	reader, err := t.router.metricsReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetLatencies(ctx, params)
+}
+
+func (t *tenantMetricsReader) GetCallRates(ctx context.Context, params *metricsstore.CallRateQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	reader, err := t.router.metricsReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetCallRates(ctx, params)
+}
+
+func (t *tenantMetricsReader) GetErrorRates(ctx context.Context, params *metricsstore.ErrorRateQueryParameters) (*jaegermetrics.MetricFamily, error) {
+	reader, err := t.router.metricsReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetErrorRates(ctx, params)
+}
+
+func (t *tenantMetricsReader) GetMinStepDuration(ctx context.Context, params *metricsstore.MinStepDurationQueryParameters) (time.Duration, error) {
+	return minMetricsStep, nil
+}
+
+// Assert that we implement the upstream interfaces
+var (
+	_ shared.StoragePlugin             = &TenantRouter{}
+	_ shared.StreamingSpanWriterPlugin = &TenantRouter{}
+	_ spanstore.Reader                 = &tenantSpanReader{}
+	_ spanstore.Writer                 = &tenantSpanWriter{}
+	_ dependencystore.Reader           = &tenantDependencyReader{}
+	_ metricsstore.Reader              = &tenantMetricsReader{}
+)
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/pkg/tenancy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenantRouter(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Get("Authorization")+" "+r.URL.Path)
+		mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/queryjobs") && r.Method == "POST":
+			w.Write([]byte(`{"id": "1"}`))
+		case strings.Contains(r.URL.Path, "/queryjobs/"):
+			w.Write([]byte(`{"done": true, "events": []}`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	client := &humio.Client{BaseURL: srv.URL, Client: &http.Client{}}
+	router := &TenantRouter{Tenants: map[string]*HumioPlugin{
+		"team-a": {Logger: hclog.NewNullLogger(), Humio: client, Repo: "repo-a", ReadToken: humio.StaticToken("read-a")},
+		"team-b": {Logger: hclog.NewNullLogger(), Humio: client, Repo: "repo-b", ReadToken: humio.StaticToken("read-b")},
+	}}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(DefaultTenantHeader, "team-b"))
+	if _, err := router.SpanReader().GetServices(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) == 0 || !strings.HasPrefix(requests[0], "Bearer read-b /api/v1/repositories/repo-b/") {
+		t.Errorf("expected requests to repo-b with the token of team-b, got %v", requests)
+	}
+
+	if h, err := router.Tenant(tenancy.WithTenant(context.Background(), "team-a")); err != nil || h.Repo != "repo-a" {
+		t.Errorf("expected tenant from context, got %v, %v", h, err)
+	}
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs(DefaultTenantHeader, "team-c")),
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs(DefaultTenantHeader, "team-a", DefaultTenantHeader, "team-b")),
+	} {
+		if _, err := router.SpanReader().GetServices(ctx); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected PermissionDenied, got %v", err)
+		}
+	}
+}
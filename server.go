@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/chlunde/humio-jaeger-storage/plugin"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	jaegermetrics "github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// healthMethodPrefix is the gRPC health service, which is not
+// authenticated so it can be used by probes
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// serveGRPC serves the plugin services with jaeger's remote storage
+// gRPC API on config.ServeAddr, until SIGINT or SIGTERM.  Several
+// collectors and query services can then share the same humio
+// connections, buffers and caches.  The metrics reader is served with
+// jaeger's MetricsQueryService API, which jaeger cannot read from
+// storage.
+func serveGRPC(config *PluginConfig, services *shared.PluginServices, metricsReader metricsstore.Reader, interceptors []grpc.UnaryServerInterceptor, logger hclog.Logger) error {
+	server, err := newGRPCServer(config, services, metricsReader, interceptors, logger)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", config.ServeAddr)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		logger.Info("Stopping gRPC server")
+		server.GracefulStop()
+	}()
+
+	logger.Info("Serving remote storage gRPC API", "addr", lis.Addr().String(), "tls", config.ServeCertFile != "")
+	return server.Serve(lis)
+}
+
+// newGRPCServer creates the server of serveGRPC, with TLS and
+// authentication as configured
+func newGRPCServer(config *PluginConfig, services *shared.PluginServices, metricsReader metricsstore.Reader, interceptors []grpc.UnaryServerInterceptor, logger hclog.Logger) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if config.ServeCertFile != "" {
+		tlsConfig, err := humio.NewServerTLSConfig(config.ServeCertFile, config.ServeKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	var streamInterceptors []grpc.StreamServerInterceptor
+	if config.ServeBearerToken != "" || config.ServeBearerTokenFile != "" {
+		token, err := tokenSource(config.ServeBearerToken, config.ServeBearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		auth := &bearerAuth{token: token, logger: logger}
+		interceptors = append([]grpc.UnaryServerInterceptor{auth.unary}, interceptors...)
+		streamInterceptors = append(streamInterceptors, auth.stream)
+	} else {
+		logger.Warn("The gRPC server does not authenticate clients")
+	}
+
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...))
+	server := grpc.NewServer(opts...)
+
+	handler := shared.NewGRPCHandlerWithPlugins(services.Store, services.ArchiveStore, services.StreamingSpanWriter)
+	if err := handler.Register(server); err != nil {
+		return nil, err
+	}
+	jaegermetrics.RegisterMetricsQueryServiceServer(server, &plugin.MetricsQueryServer{Reader: metricsReader})
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	return server, nil
+}
+
+// bearerAuth rejects requests without the bearer token, either in the
+// "authorization" metadata as "Bearer <token>", or in the
+// "bearer.token" metadata used by jaeger's gRPC storage client to
+// propagate the token of the UI user.  jaeger never sends a token of
+// its own, so the collector can only authenticate through a proxy
+// adding the header.
+type bearerAuth struct {
+	token  humio.TokenSource
+	logger hclog.Logger
+}
+
+func (a *bearerAuth) authenticate(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return nil
+	}
+
+	want, err := a.token.Token()
+	if err != nil {
+		a.logger.Error("Reading bearer token failed", "err", err)
+		return status.Error(codes.Internal, "reading bearer token failed")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		scheme, got, found := strings.Cut(value, " ")
+		if found && strings.EqualFold(scheme, "Bearer") && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+			return nil
+		}
+	}
+	for _, got := range md.Get(shared.BearerTokenKey) {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+func (a *bearerAuth) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authenticate(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *bearerAuth) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.authenticate(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/chlunde/humio-jaeger-storage/humio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/pkg/bearertoken"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	"github.com/jaegertracing/jaeger/plugin/storage/memory"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestBearerAuth(t *testing.T) {
+	auth := &bearerAuth{token: humio.StaticToken("secret"), logger: hclog.NewNullLogger()}
+	const method = "/jaeger.storage.v1.SpanWriterPlugin/WriteSpan"
+
+	for _, tc := range []struct {
+		authorization []string
+		method        string
+		code          codes.Code
+	}{
+		{[]string{"Bearer secret"}, method, codes.OK},
+		{[]string{"bearer secret"}, method, codes.OK},
+		{[]string{"Basic c2VjcmV0", "Bearer secret"}, method, codes.OK},
+		{[]string{"Bearer wrong"}, method, codes.Unauthenticated},
+		{[]string{"secret"}, method, codes.Unauthenticated},
+		{nil, method, codes.Unauthenticated},
+		{nil, "/grpc.health.v1.Health/Check", codes.OK},
+	} {
+		ctx := context.Background()
+		if tc.authorization != nil {
+			md := metadata.MD{"authorization": tc.authorization}
+			ctx = metadata.NewIncomingContext(ctx, md)
+		}
+
+		if code := status.Code(auth.authenticate(ctx, tc.method)); code != tc.code {
+			t.Errorf("%v %s: got %v, want %v", tc.authorization, tc.method, code, tc.code)
+		}
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.MD{shared.BearerTokenKey: []string{"secret"}})
+	if err := auth.authenticate(ctx, method); err != nil {
+		t.Errorf("bearer.token metadata rejected: %v", err)
+	}
+}
+
+// memoryPlugin serves jaeger's in-memory storage
+type memoryPlugin struct {
+	store *memory.Store
+}
+
+func (p memoryPlugin) SpanReader() spanstore.Reader             { return p.store }
+func (p memoryPlugin) SpanWriter() spanstore.Writer             { return p.store }
+func (p memoryPlugin) DependencyReader() dependencystore.Reader { return p.store }
+
+// TestGRPCServerJaegerClient calls the server with the gRPC storage
+// client of jaeger
+func TestGRPCServerJaegerClient(t *testing.T) {
+	config := &PluginConfig{ServeBearerToken: "secret"}
+	services := &shared.PluginServices{Store: memoryPlugin{memory.NewStore()}}
+	server, err := newGRPCServer(config, services, nil, nil, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// addAuthorization adds the header as a proxy in front of the
+	// server would
+	addAuthorization := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []grpc.DialOption
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no token", nil, context.Background(), codes.Unauthenticated},
+		{"propagated token", nil, bearertoken.ContextWithBearerToken(context.Background(), "secret"), codes.OK},
+		{"wrong propagated token", nil, bearertoken.ContextWithBearerToken(context.Background(), "user"), codes.Unauthenticated},
+		{"authorization header", []grpc.DialOption{grpc.WithUnaryInterceptor(addAuthorization)}, context.Background(), codes.OK},
+	} {
+		conn, err := grpc.Dial(lis.Addr().String(), append(tc.opts, grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The client wraps the status in a "plugin error"
+		_, err = shared.NewGRPCClient(conn).SpanReader().GetServices(tc.ctx)
+		if code := status.Code(errors.Unwrap(err)); code != tc.code {
+			t.Errorf("%s: got %v (%v), want %v", tc.name, code, err, tc.code)
+		}
+
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		if err != nil || resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Errorf("%s: health check got %v %v", tc.name, resp, err)
+		}
+		conn.Close()
+	}
+}
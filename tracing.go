@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// initTracing sets up OpenTelemetry to trace ourself.  The exporter is
+// configured with the standard OTEL_EXPORTER_OTLP_* environment
+// variables (OTLP over HTTP by default, or gRPC if the protocol is
+// "grpc"), and the resource with OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES.  The sample ratio from the plugin config
+// overrides OTEL_TRACES_SAMPLER.  The returned function flushes
+// buffered spans.
+func initTracing(config *PluginConfig, logger hclog.Logger) (func(), error) {
+	ctx := context.Background()
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("Exporting traces failed", "err", err)
+	}))
+
+	var client otlptrace.Client
+	switch otlpProtocol() {
+	case "grpc":
+		client = otlptracegrpc.NewClient()
+	default:
+		client = otlptracehttp.NewClient()
+	}
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	}
+	if ratio := config.SelfTracingSampleRatio; ratio != 0 {
+		opts = append(opts, sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))))
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	logger.Info("Self-tracing enabled", "sampleRatio", config.SelfTracingSampleRatio, "ingest", config.SelfTracingIngest)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("Flushing traces failed", "err", err)
+		}
+	}, nil
+}
+
+// otlpProtocol returns the OTLP protocol for traces from the
+// environment, as the exporters do not select it themselves
+func otlpProtocol() string {
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"); protocol != "" {
+		return protocol
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+}